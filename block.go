@@ -0,0 +1,134 @@
+package collector
+
+import (
+  "fmt"
+  "strings"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/conv"
+)
+
+const (
+  fetchEnable        = "Fetch.enable"
+  fetchFailRequest   = "Fetch.failRequest"
+  fetchRequestPaused = "Fetch.requestPaused"
+)
+
+// 可以拦截的资源类型（block.types）及其在CDP中的名称（Network.ResourceType），
+// 不能拦截document（页面本身）
+var resourceTypes = map[string]string{
+  "stylesheet":  "Stylesheet",
+  "image":       "Image",
+  "media":       "Media",
+  "font":        "Font",
+  "script":      "Script",
+  "texttrack":   "TextTrack",
+  "xhr":         "XHR",
+  "fetch":       "Fetch",
+  "eventsource": "EventSource",
+  "websocket":   "WebSocket",
+  "manifest":    "Manifest",
+  "ping":        "Ping",
+  "other":       "Other",
+}
+
+// 拦截请求（通过Fetch域，匹配的请求会被取消），
+// 被拦截的请求数可以通过Page.Blocked()获取
+type Block struct {
+  // 资源类型，如image、media、font、stylesheet
+  Types []string `yaml:"types"`
+
+  // URL通配符（*匹配任意字符，?匹配单个字符），如*.mp4、*/track?*
+  Urls []string `yaml:"urls"`
+
+  // 域名（包括子域名），如doubleclick.net
+  Domains []string `yaml:"domains"`
+
+  patterns []map[string]interface{} `yaml:"-"`
+}
+
+func (b *Block) init() {
+  if b == nil {
+    return
+  }
+  b.patterns = make([]map[string]interface{}, 0, len(b.Types)+len(b.Urls)+len(b.Domains)*2)
+  for _, t := range b.Types {
+    b.patterns = append(b.patterns, map[string]interface{}{"urlPattern": "*", "resourceType": resourceTypes[strings.ToLower(t)]})
+  }
+  for _, u := range b.Urls {
+    b.patterns = append(b.patterns, map[string]interface{}{"urlPattern": u})
+  }
+  for _, d := range b.Domains {
+    b.patterns = append(b.patterns,
+      map[string]interface{}{"urlPattern": "*://" + d + "/*"},
+      map[string]interface{}{"urlPattern": "*://*." + d + "/*"},
+    )
+  }
+}
+
+func (b *Block) validate(v *validator, path ...interface{}) {
+  if b == nil {
+    return
+  }
+  for i, t := range b.Types {
+    if _, ok := resourceTypes[strings.ToLower(t)]; !ok {
+      v.add(fmt.Sprintf("unknown resource type %q", t), sub(path, "types", i)...)
+    }
+  }
+  for i, u := range b.Urls {
+    if u == "" {
+      v.add("empty url pattern", sub(path, "urls", i)...)
+    }
+  }
+  for i, d := range b.Domains {
+    if d == "" || strings.ContainsAny(d, "/:*") {
+      v.add(fmt.Sprintf("invalid domain %q", d), sub(path, "domains", i)...)
+    }
+  }
+}
+
+// 被拦截的请求数
+type BlockStats struct {
+  Total int
+
+  // 按资源类型（CDP中的名称，如Image）统计
+  Types map[string]int
+}
+
+// 所有尝试中被拦截的请求数
+func (p *Page) Blocked() BlockStats {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  ret := BlockStats{Total: p.blocked.Total, Types: make(map[string]int, len(p.blocked.Types))}
+  for k, v := range p.blocked.Types {
+    ret.Types[k] = v
+  }
+  return ret
+}
+
+// 开启拦截（在导航之前调用）
+func (a *attempt) block() {
+  b := a.p.Rule.Block
+  if b == nil || len(b.patterns) == 0 {
+    return
+  }
+  a.tab.Subscribe(fetchRequestPaused)
+  a.tab.Call(fetchEnable, map[string]interface{}{"patterns": b.patterns})
+}
+
+// 只有匹配的请求才会暂停，所以直接取消
+func (a *attempt) onRequestPaused(msg *cdp.Message) {
+  typ := conv.GetString(msg.Params, "resourceType", "Other")
+  p := a.p
+  p.mu.Lock()
+  if p.blocked.Types == nil {
+    p.blocked.Types = make(map[string]int, 8)
+  }
+  p.blocked.Total++
+  p.blocked.Types[typ]++
+  p.mu.Unlock()
+  a.tab.Call(fetchFailRequest, map[string]interface{}{
+    "requestId":   conv.GetString(msg.Params, "requestId", ""),
+    "errorReason": "BlockedByClient",
+  })
+}
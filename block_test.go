@@ -0,0 +1,89 @@
+package collector
+
+import (
+  "context"
+  "reflect"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+var blockRule = `id: "b"
+group: "g"
+patterns: ["example.com"]
+block:
+  types: ["image", "Font"]
+  urls: ["*.mp4"]
+  domains: ["doubleclick.net"]
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+`
+
+func TestBlock(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(blockRule)); e != nil {
+    t.Fatal(e)
+  }
+  var tab *fakeTab
+  var mu sync.Mutex
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    mu.Lock()
+    defer mu.Unlock()
+    tab = newFakeTab(h, func(string) interface{} { return "ok" })
+    return tab, nil
+  }
+  p := NewPage("http://example.com", "g")
+  h := &recordHandler{done: make(chan struct{})}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  calls := tab.Calls(fetchEnable)
+  if len(calls) != 1 {
+    t.Fatalf("want 1 %s, got %d", fetchEnable, len(calls))
+  }
+  want := []map[string]interface{}{
+    {"urlPattern": "*", "resourceType": "Image"},
+    {"urlPattern": "*", "resourceType": "Font"},
+    {"urlPattern": "*.mp4"},
+    {"urlPattern": "*://doubleclick.net/*"},
+    {"urlPattern": "*://*.doubleclick.net/*"},
+  }
+  if got := calls[0].Params["patterns"]; !reflect.DeepEqual(got, want) {
+    t.Fatalf("want patterns %v, got %v", want, got)
+  }
+
+  a := &attempt{p: p, tab: tab}
+  for _, typ := range []string{"Image", "Image", "Font"} {
+    a.OnCdpEvent(&cdp.Message{Method: fetchRequestPaused, Params: map[string]interface{}{"requestId": "r", "resourceType": typ}})
+  }
+  stats := p.Blocked()
+  if stats.Total != 3 || stats.Types["Image"] != 2 || stats.Types["Font"] != 1 {
+    t.Fatalf("unexpected stats %+v", stats)
+  }
+  if n := len(tab.Calls(fetchFailRequest)); n != 3 {
+    t.Fatalf("want 3 %s, got %d", fetchFailRequest, n)
+  }
+}
+
+func TestValidateBlock(t *testing.T) {
+  _, e := ParseRule([]byte(strings.Replace(blockRule, `["image", "Font"]`, `["document"]`, 1)))
+  if e == nil || !strings.Contains(e.Error(), `unknown resource type "document"`) {
+    t.Fatalf("unexpected %v", e)
+  }
+  _, e = ParseRule([]byte(strings.Replace(blockRule, `["doubleclick.net"]`, `["http://x.com"]`, 1)))
+  if e == nil || !strings.Contains(e.Error(), "invalid domain") {
+    t.Fatalf("unexpected %v", e)
+  }
+}
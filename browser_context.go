@@ -0,0 +1,342 @@
+package collector
+
+import (
+  "encoding/json"
+  "errors"
+  "net/http"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "time"
+
+  "github.com/gorilla/websocket"
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/conv"
+)
+
+const (
+  targetCreateBrowserContext  = "Target.createBrowserContext"
+  targetDisposeBrowserContext = "Target.disposeBrowserContext"
+
+  // 浏览器连接上的调用等待响应的时间
+  browserCallTimeout = time.Second * 10
+)
+
+var (
+  ErrNoBrowserContext = errors.New("browser context not supported")
+  ErrBrowserClosed    = errors.New("browser connection closed")
+)
+
+// 浏览器连接上的消息，sessionId不为空时是发给（或来自）某个Target的
+type browserMessage struct {
+  Id        int32                  `json:"id,omitempty"`
+  Method    string                 `json:"method,omitempty"`
+  Params    map[string]interface{} `json:"params,omitempty"`
+  Result    map[string]interface{} `json:"result,omitempty"`
+  Error     map[string]interface{} `json:"error,omitempty"`
+  SessionId string                 `json:"sessionId,omitempty"`
+}
+
+type browserCall struct {
+  sessionId string
+  method    string
+  ch        chan *cdp.Message
+}
+
+// 浏览器级别的连接（/json/version中的webSocketDebuggerUrl），
+// BrowserContext只能通过该连接创建和销毁，
+// 其中的Target通过flatten模式的session在同一个连接上通信（不需要额外的Tab）
+type browserConn struct {
+  conn *websocket.Conn
+
+  lastId int32
+  closed int32
+
+  pending  map[int32]*browserCall
+  sessions map[string]*contextTab
+  mu       sync.Mutex
+
+  // 写需要互斥
+  wmu sync.Mutex
+}
+
+// 按endpoint（如http://127.0.0.1:9222/json）共用的浏览器连接，断开后重新连接
+var browsers = struct {
+  conns map[string]*browserConn
+  mu    sync.Mutex
+}{conns: make(map[string]*browserConn, 2)}
+
+func browserOf(endpoint string) (*browserConn, error) {
+  browsers.mu.Lock()
+  defer browsers.mu.Unlock()
+  if b, ok := browsers.conns[endpoint]; ok && atomic.LoadInt32(&b.closed) == 0 {
+    return b, nil
+  }
+  b, e := dialBrowser(endpoint)
+  if e != nil {
+    return nil, e
+  }
+  browsers.conns[endpoint] = b
+  return b, nil
+}
+
+func dialBrowser(endpoint string) (*browserConn, error) {
+  client := &http.Client{Timeout: browserCallTimeout}
+  resp, e := client.Get(strings.TrimSuffix(endpoint, "/") + "/version")
+  if e != nil {
+    return nil, e
+  }
+  defer resp.Body.Close()
+  var version struct {
+    WebSocketDebuggerUrl string `json:"webSocketDebuggerUrl"`
+  }
+  if e = json.NewDecoder(resp.Body).Decode(&version); e != nil {
+    return nil, e
+  }
+  if version.WebSocketDebuggerUrl == "" {
+    return nil, ErrNoBrowserContext
+  }
+  conn, _, e := websocket.DefaultDialer.Dial(version.WebSocketDebuggerUrl, nil)
+  if e != nil {
+    return nil, e
+  }
+  b := &browserConn{
+    conn:     conn,
+    pending:  make(map[int32]*browserCall, 16),
+    sessions: make(map[string]*contextTab, 8),
+  }
+  go b.read()
+  return b, nil
+}
+
+// 发送消息（sessionId为空时发给浏览器），连接已断开时返回nil
+func (b *browserConn) call(sessionId, method string, params map[string]interface{}) (int32, chan *cdp.Message) {
+  if atomic.LoadInt32(&b.closed) != 0 {
+    return 0, nil
+  }
+  id := atomic.AddInt32(&b.lastId, 1)
+  ch := make(chan *cdp.Message, 1)
+  b.mu.Lock()
+  b.pending[id] = &browserCall{sessionId: sessionId, method: method, ch: ch}
+  b.mu.Unlock()
+  b.wmu.Lock()
+  e := b.conn.WriteJSON(&browserMessage{Id: id, Method: method, Params: params, SessionId: sessionId})
+  b.wmu.Unlock()
+  if e != nil {
+    b.mu.Lock()
+    delete(b.pending, id)
+    b.mu.Unlock()
+    b.close()
+    return 0, nil
+  }
+  return id, ch
+}
+
+// 调用浏览器的方法并等待结果
+func (b *browserConn) wait(method string, params map[string]interface{}) (*cdp.Message, error) {
+  _, ch := b.call("", method, params)
+  if ch == nil {
+    return nil, ErrBrowserClosed
+  }
+  done := make(chan struct{})
+  t := timers.afterFunc(browserCallTimeout, func() {
+    close(done)
+  })
+  select {
+  case msg := <-ch:
+    timers.stop(t)
+    return msg, checkResult(msg)
+  case <-done:
+    return nil, ErrCallFailed
+  }
+}
+
+func (b *browserConn) read() {
+  for {
+    msg := &browserMessage{}
+    if e := b.conn.ReadJSON(msg); e != nil {
+      b.close()
+      return
+    }
+    if msg.Id != 0 {
+      b.mu.Lock()
+      c, ok := b.pending[msg.Id]
+      delete(b.pending, msg.Id)
+      b.mu.Unlock()
+      if ok {
+        resp := &cdp.Message{Id: msg.Id, Method: c.method, Result: msg.Result}
+        // cdp.Message没有error字段，放在Params中（由checkResult转换为*CallError）
+        if msg.Error != nil {
+          resp.Params = map[string]interface{}{"error": msg.Error}
+        }
+        c.ch <- resp
+      }
+      continue
+    }
+    sessionId := msg.SessionId
+    if msg.Method == cdp.Target.DetachedFromTarget {
+      sessionId = conv.GetString(msg.Params, "sessionId", "")
+      b.detach(sessionId)
+      continue
+    }
+    b.mu.Lock()
+    t := b.sessions[sessionId]
+    b.mu.Unlock()
+    if t != nil {
+      t.onEvent(&cdp.Message{Method: msg.Method, Params: msg.Params})
+    }
+  }
+}
+
+// Target已断开（如崩溃或被关闭），该session正在等待的调用都返回失败
+func (b *browserConn) detach(sessionId string) {
+  b.mu.Lock()
+  t := b.sessions[sessionId]
+  delete(b.sessions, sessionId)
+  for id, c := range b.pending {
+    if c.sessionId == sessionId {
+      delete(b.pending, id)
+      c.ch <- &cdp.Message{Id: id}
+    }
+  }
+  b.mu.Unlock()
+  if t != nil {
+    t.mu.Lock()
+    t.detached = true
+    t.mu.Unlock()
+  }
+}
+
+// 连接断开，所有等待的调用都返回失败
+func (b *browserConn) close() {
+  if !atomic.CompareAndSwapInt32(&b.closed, 0, 1) {
+    return
+  }
+  b.conn.Close()
+  b.mu.Lock()
+  sessions := make([]string, 0, len(b.sessions))
+  for id := range b.sessions {
+    sessions = append(sessions, id)
+  }
+  for id, c := range b.pending {
+    delete(b.pending, id)
+    c.ch <- &cdp.Message{Id: id}
+  }
+  b.mu.Unlock()
+  for _, id := range sessions {
+    b.detach(id)
+  }
+}
+
+// 在新的BrowserContext中创建Tab，proxy不为空时该BrowserContext中的请求都通过该代理
+func (b *browserConn) newContextTab(h cdp.Handler, proxy string) (*contextTab, error) {
+  t := &contextTab{b: b, handler: h, events: make(map[string]bool, 16)}
+  var params map[string]interface{}
+  if proxy != "" {
+    params = map[string]interface{}{"proxyServer": proxy}
+  }
+  msg, e := b.wait(targetCreateBrowserContext, params)
+  if e == nil {
+    t.contextId = conv.GetString(msg.Result, "browserContextId", "")
+    msg, e = b.wait(cdp.Target.CreateTarget, map[string]interface{}{"url": "about:blank", "browserContextId": t.contextId})
+  }
+  if e == nil {
+    t.targetId = conv.GetString(msg.Result, "targetId", "")
+    msg, e = b.wait(cdp.Target.AttachToTarget, map[string]interface{}{"targetId": t.targetId, "flatten": true})
+  }
+  if e == nil {
+    t.sessionId = conv.GetString(msg.Result, "sessionId", "")
+    b.mu.Lock()
+    b.sessions[t.sessionId] = t
+    b.mu.Unlock()
+    return t, nil
+  }
+  t.Close()
+  return nil, e
+}
+
+// 通过*cdp.Chrome的浏览器连接创建BrowserContext中的Tab
+func chromeContext(chrome *cdp.Chrome) func(cdp.Handler, string) (cdpTab, error) {
+  return func(h cdp.Handler, proxy string) (cdpTab, error) {
+    b, e := browserOf(chrome.Endpoint)
+    if e != nil {
+      return nil, e
+    }
+    t, e := b.newContextTab(h, proxy)
+    if e != nil {
+      return nil, e
+    }
+    return t, nil
+  }
+}
+
+// 在独立的BrowserContext（类似隐身窗口，cookies、localStorage和缓存都不共享）中的Tab，
+// Close时关闭Target并销毁BrowserContext
+type contextTab struct {
+  b       *browserConn
+  handler cdp.Handler
+
+  contextId string
+  targetId  string
+  sessionId string
+
+  closed int32
+
+  // Target已断开，之后的Call都返回nil
+  detached bool
+
+  events map[string]bool
+  mu     sync.Mutex
+}
+
+func (t *contextTab) Call(method string, params map[string]interface{}) (int32, chan *cdp.Message) {
+  if atomic.LoadInt32(&t.closed) != 0 {
+    return 0, nil
+  }
+  t.mu.Lock()
+  detached := t.detached
+  t.mu.Unlock()
+  if detached {
+    return 0, nil
+  }
+  return t.b.call(t.sessionId, method, params)
+}
+
+func (t *contextTab) Fire(event string, params map[string]interface{}) {
+  if t.handler != nil {
+    go t.handler.OnCdpEvent(&cdp.Message{Method: event, Params: params})
+  }
+}
+
+func (t *contextTab) Subscribe(events ...string) {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  for _, e := range events {
+    t.events[e] = true
+  }
+}
+
+// 关闭Target后再销毁BrowserContext
+func (t *contextTab) Close() {
+  if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+    return
+  }
+  if t.targetId != "" {
+    t.b.wait(cdp.Target.CloseTarget, map[string]interface{}{"targetId": t.targetId})
+  }
+  if t.contextId != "" {
+    t.b.wait(targetDisposeBrowserContext, map[string]interface{}{"browserContextId": t.contextId})
+  }
+  if t.sessionId != "" {
+    t.b.detach(t.sessionId)
+  }
+}
+
+func (t *contextTab) onEvent(msg *cdp.Message) {
+  t.mu.Lock()
+  ok := t.events[msg.Method]
+  t.mu.Unlock()
+  if ok && t.handler != nil {
+    go t.handler.OnCdpEvent(msg)
+  }
+}
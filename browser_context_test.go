@@ -0,0 +1,368 @@
+package collector
+
+import (
+  "context"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "strconv"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/gorilla/websocket"
+  "github.com/kwf2030/cdp"
+)
+
+// 模拟Chrome的浏览器连接（/json/version和webSocketDebuggerUrl），
+// 创建的Target由fakeTab代替，其响应和事件带上sessionId写回连接
+type fakeBrowser struct {
+  server   *httptest.Server
+  evalFunc func(string) interface{}
+  lastId   int32
+
+  mu       sync.Mutex
+  conns    []*fakeConn
+  created  []string
+  disposed []string
+
+  // 创建BrowserContext时的proxyServer
+  proxies []string
+
+  // 浏览器连接上Browser.grantPermissions的参数
+  grants []map[string]interface{}
+
+  // 按创建顺序的Target
+  targets  []*fakeTab
+  sessions map[string]*fakeTab
+
+  // 默认BrowserContext中打开的Tab
+  tabs []*fakeTab
+}
+
+type fakeConn struct {
+  conn *websocket.Conn
+  mu   sync.Mutex
+}
+
+func (c *fakeConn) write(msg *browserMessage) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.conn.WriteJSON(msg)
+}
+
+// Target的事件写回浏览器连接
+type sessionForwarder struct {
+  c         *fakeConn
+  sessionId string
+}
+
+func (f *sessionForwarder) OnCdpEvent(msg *cdp.Message) {
+  f.c.write(&browserMessage{Method: msg.Method, Params: msg.Params, SessionId: f.sessionId})
+}
+
+func (f *sessionForwarder) OnCdpResponse(msg *cdp.Message) bool {
+  return false
+}
+
+func newFakeBrowser(t *testing.T, evalFunc func(string) interface{}) *fakeBrowser {
+  b := &fakeBrowser{evalFunc: evalFunc, sessions: make(map[string]*fakeTab, 4)}
+  upgrader := &websocket.Upgrader{}
+  mux := http.NewServeMux()
+  mux.HandleFunc("/json/version", func(w http.ResponseWriter, r *http.Request) {
+    json.NewEncoder(w).Encode(map[string]string{
+      "webSocketDebuggerUrl": "ws" + strings.TrimPrefix(b.server.URL, "http") + "/devtools/browser/1",
+    })
+  })
+  mux.HandleFunc("/devtools/browser/1", func(w http.ResponseWriter, r *http.Request) {
+    conn, e := upgrader.Upgrade(w, r, nil)
+    if e != nil {
+      return
+    }
+    c := &fakeConn{conn: conn}
+    b.mu.Lock()
+    b.conns = append(b.conns, c)
+    b.mu.Unlock()
+    b.serve(c)
+  })
+  b.server = httptest.NewServer(mux)
+  // 先断开浏览器连接，否则Close会等待连接的handler返回
+  t.Cleanup(func() {
+    b.mu.Lock()
+    for _, c := range b.conns {
+      c.conn.Close()
+    }
+    b.mu.Unlock()
+    b.server.Close()
+  })
+  return b
+}
+
+func (b *fakeBrowser) serve(c *fakeConn) {
+  defer c.conn.Close()
+  for {
+    msg := &browserMessage{}
+    if e := c.conn.ReadJSON(msg); e != nil {
+      return
+    }
+    if msg.SessionId != "" {
+      b.mu.Lock()
+      tab := b.sessions[msg.SessionId]
+      b.mu.Unlock()
+      go func() {
+        resp := &browserMessage{Id: msg.Id, SessionId: msg.SessionId}
+        if tab != nil {
+          if _, ch := tab.Call(msg.Method, msg.Params); ch != nil {
+            resp.Result = (<-ch).Result
+          }
+        }
+        c.write(resp)
+      }()
+      continue
+    }
+    resp := &browserMessage{Id: msg.Id, Result: map[string]interface{}{}}
+    switch msg.Method {
+    case targetCreateBrowserContext:
+      ctxId := "ctx" + strconv.Itoa(int(atomic.AddInt32(&b.lastId, 1)))
+      proxy, _ := msg.Params["proxyServer"].(string)
+      if strings.HasPrefix(proxy, "bad") {
+        resp.Result = nil
+        resp.Error = map[string]interface{}{"code": -32602, "message": "Invalid proxy server"}
+        break
+      }
+      b.mu.Lock()
+      b.created = append(b.created, ctxId)
+      b.proxies = append(b.proxies, proxy)
+      b.mu.Unlock()
+      resp.Result["browserContextId"] = ctxId
+    case targetDisposeBrowserContext:
+      b.mu.Lock()
+      b.disposed = append(b.disposed, msg.Params["browserContextId"].(string))
+      b.mu.Unlock()
+    case cdp.Target.CreateTarget:
+      resp.Result["targetId"] = "t-" + msg.Params["browserContextId"].(string)
+    case cdp.Target.AttachToTarget:
+      // 只支持flatten模式
+      if msg.Params["flatten"] != true {
+        resp.Result = nil
+        break
+      }
+      sessionId := "s-" + msg.Params["targetId"].(string)
+      tab := newFakeTab(&sessionForwarder{c: c, sessionId: sessionId}, b.evalFunc)
+      b.mu.Lock()
+      b.sessions[sessionId] = tab
+      b.targets = append(b.targets, tab)
+      b.mu.Unlock()
+      resp.Result["sessionId"] = sessionId
+    case browserGrantPermissions:
+      b.mu.Lock()
+      b.grants = append(b.grants, msg.Params)
+      b.mu.Unlock()
+    case cdp.Target.CloseTarget:
+      sessionId := "s-" + msg.Params["targetId"].(string)
+      b.detach(sessionId)
+    default:
+      // 页面的方法不能在浏览器连接上调用
+      resp.Result = nil
+      resp.Error = map[string]interface{}{"code": -32601, "message": fmt.Sprintf("'%s' wasn't found", msg.Method)}
+    }
+    c.write(resp)
+  }
+}
+
+// 关闭Target并发出Target.detachedFromTarget
+func (b *fakeBrowser) detach(sessionId string) {
+  b.mu.Lock()
+  tab := b.sessions[sessionId]
+  delete(b.sessions, sessionId)
+  conns := b.conns
+  b.mu.Unlock()
+  if tab == nil {
+    return
+  }
+  tab.Close()
+  for _, c := range conns {
+    c.write(&browserMessage{Method: cdp.Target.DetachedFromTarget, Params: map[string]interface{}{"sessionId": sessionId}})
+  }
+}
+
+func (b *fakeBrowser) endpoint() string {
+  return b.server.URL + "/json"
+}
+
+func (b *fakeBrowser) newTab() func(cdp.Handler) (cdpTab, error) {
+  return func(h cdp.Handler) (cdpTab, error) {
+    tab := newFakeTab(h, b.evalFunc)
+    b.mu.Lock()
+    b.tabs = append(b.tabs, tab)
+    b.mu.Unlock()
+    return tab, nil
+  }
+}
+
+func (b *fakeBrowser) newContext() func(cdp.Handler, string) (cdpTab, error) {
+  return chromeContext(&cdp.Chrome{Endpoint: b.endpoint()})
+}
+
+func (b *fakeBrowser) counts() (int, int) {
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  return len(b.created), len(b.disposed)
+}
+
+var isolatedRule = `id: "i"
+group: "g"
+patterns: ["example.com"]
+isolated: %v
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+`
+
+func TestIsolated(t *testing.T) {
+  for _, tc := range []struct {
+    rule, group bool
+    want        int
+  }{{false, false, 0}, {true, false, 1}, {false, true, 1}} {
+    rg := NewRuleGroup("g")
+    if e := rg.AppendBytes([]byte(fmt.Sprintf(isolatedRule, tc.rule))); e != nil {
+      t.Fatal(e)
+    }
+    rg.SetIsolated(tc.group)
+    b := newFakeBrowser(t, func(string) interface{} { return "title" })
+    p := NewPage("http://example.com/1", "g")
+    p.newContext = b.newContext()
+    h := &recordHandler{done: make(chan struct{})}
+    if e := p.collect(context.Background(), b.newTab(), rg, h); e != nil {
+      t.Fatal(e)
+    }
+    select {
+    case <-h.done:
+    case <-time.After(time.Second * 5):
+      t.Fatal("timeout")
+    }
+    if p.Err() != nil {
+      t.Fatal(p.Err())
+    }
+    if h.record["a"] != "title" {
+      t.Fatalf("want title, got %v", h.record["a"])
+    }
+    if created, _ := b.counts(); created != tc.want {
+      t.Fatalf("%+v: want %d contexts, got %d", tc, tc.want, created)
+    }
+    p.Close()
+    if _, disposed := b.counts(); disposed != tc.want {
+      t.Fatalf("%+v: want %d disposed, got %d", tc, tc.want, disposed)
+    }
+    if tc.want == 0 {
+      continue
+    }
+    // 所有CDP调用都发给了BrowserContext中的Target，没有额外打开Tab
+    if len(b.targets[0].Calls(cdp.Page.Navigate)) != 1 || len(b.tabs) != 0 {
+      t.Fatal("navigate not sent to target")
+    }
+    if atomic.LoadInt32(&b.targets[0].closed) == 0 {
+      t.Fatal("target not closed")
+    }
+  }
+}
+
+func TestIsolatedConcurrent(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(fmt.Sprintf(isolatedRule, true))); e != nil {
+    t.Fatal(e)
+  }
+  const n = 20
+  b := newFakeBrowser(t, func(string) interface{} { return "title" })
+  wg := &sync.WaitGroup{}
+  wg.Add(n)
+  h := &countHandler{wg: wg}
+  pages := make([]*Page, n)
+  for i := 0; i < n; i++ {
+    pages[i] = NewPage("http://example.com/"+strconv.Itoa(i), "g")
+    pages[i].newContext = b.newContext()
+    if e := pages[i].collect(context.Background(), b.newTab(), rg, h); e != nil {
+      t.Fatal(e)
+    }
+  }
+  wg.Wait()
+  for _, p := range pages {
+    p.Close()
+  }
+  created, disposed := b.counts()
+  if created != n || disposed != n || h.fields != n {
+    t.Fatalf("want %d, got %d created, %d disposed, %d fields", n, created, disposed, h.fields)
+  }
+  // 共用一个浏览器连接
+  if len(b.conns) != 1 {
+    t.Fatalf("want 1 browser connection, got %d", len(b.conns))
+  }
+}
+
+func TestContextTabDetached(t *testing.T) {
+  b := newFakeBrowser(t, nil)
+  conn, e := browserOf(b.endpoint())
+  if e != nil {
+    t.Fatal(e)
+  }
+  tab, e := conn.newContextTab(&sessionForwarder{}, "")
+  if e != nil {
+    t.Fatal(e)
+  }
+  // 断开后正在等待和之后的调用都失败
+  ch := make(chan *cdp.Message, 1)
+  conn.mu.Lock()
+  conn.pending[-1] = &browserCall{sessionId: tab.sessionId, ch: ch}
+  conn.mu.Unlock()
+  b.detach(tab.sessionId)
+  select {
+  case msg := <-ch:
+    if checkResult(msg) != ErrCallFailed {
+      t.Fatal("want call failed")
+    }
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if _, ch := tab.Call(cdp.Runtime.Evaluate, nil); ch != nil {
+    t.Fatal("want nil chan after detached")
+  }
+  tab.Close()
+  if _, disposed := b.counts(); disposed != 1 {
+    t.Fatal("context not disposed")
+  }
+}
+
+func TestNoBrowserContext(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(fmt.Sprintf(isolatedRule, true))); e != nil {
+    t.Fatal(e)
+  }
+  p := NewPage("http://example.com/1", "g")
+  if e := p.collect(context.Background(), fakeNewTab(nil), rg, &recordHandler{}); e != ErrNoBrowserContext {
+    t.Fatalf("want ErrNoBrowserContext, got %v", e)
+  }
+}
+
+func TestBrowserCallError(t *testing.T) {
+  b := newFakeBrowser(t, nil)
+  conn, e := browserOf(b.endpoint())
+  if e != nil {
+    t.Fatal(e)
+  }
+  _, e = conn.newContextTab(&sessionForwarder{}, "bad:1")
+  var ce *CallError
+  if !errors.As(e, &ce) || !errors.Is(e, ErrCallFailed) {
+    t.Fatalf("want *CallError, got %v", e)
+  }
+  if ce.Method != targetCreateBrowserContext || ce.Code != -32602 || ce.Message != "Invalid proxy server" {
+    t.Fatalf("unexpected %+v", ce)
+  }
+  if !strings.Contains(e.Error(), "Invalid proxy server") {
+    t.Fatalf("message missing from %q", e.Error())
+  }
+}
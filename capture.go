@@ -0,0 +1,293 @@
+package collector
+
+import (
+  "encoding/base64"
+  "fmt"
+  "time"
+
+  "github.com/kwf2030/commons/conv"
+)
+
+const (
+  pageCaptureScreenshot = "Page.captureScreenshot"
+  pageGetLayoutMetrics  = "Page.getLayoutMetrics"
+  pagePrintToPDF        = "Page.printToPDF"
+  pageCaptureSnapshot   = "Page.captureSnapshot"
+)
+
+// Capture.Type的可选值
+const (
+  // 截图（当前视口，full_page为true时为整个页面）
+  CaptureScreenshot = "screenshot"
+
+  // 元素截图（selector或xpath匹配的第一个元素）
+  CaptureElement = "element"
+
+  // PDF（只在headless模式下可用）
+  CapturePDF = "pdf"
+
+  // MHTML快照（包括页面引用的资源）
+  CaptureMHTML = "mhtml"
+)
+
+// Capture.Stage的可选值
+const (
+  // prepare之后（没有prepare时为页面加载完成后）
+  CaptureAfterPrepare = "prepare"
+
+  // 所有字段采集完成后（OnFields之前）
+  CaptureAfterFields = "fields"
+
+  // 每次循环的eval之后（OnLoop之前）
+  CaptureEachLoop = "loop"
+)
+
+// 截图格式
+const (
+  FormatPNG  = "png"
+  FormatJPEG = "jpeg"
+)
+
+// 保存页面的截图、PDF或MHTML，用于核对采集的数据，
+// 结果通过CaptureHandler.OnCapture返回
+type Capture struct {
+  Name string `yaml:"name"`
+
+  // screenshot、element、pdf或mhtml
+  Type string `yaml:"type"`
+
+  // prepare、fields（默认）或loop
+  Stage string `yaml:"stage"`
+
+  // 截图格式，png（默认）或jpeg
+  Format string `yaml:"format"`
+
+  // jpeg的质量（1-100）
+  Quality int `yaml:"quality"`
+
+  // 截取整个页面（screenshot）
+  FullPage bool `yaml:"full_page"`
+
+  // 截取的元素（element），selector和xpath二选一
+  Selector string `yaml:"selector"`
+  Xpath    string `yaml:"xpath"`
+
+  // 横向打印（pdf）
+  Landscape bool `yaml:"landscape"`
+}
+
+func (c *Capture) init() {
+  if c.Stage == "" {
+    c.Stage = CaptureAfterFields
+  }
+  if c.Format == "" && (c.Type == CaptureScreenshot || c.Type == CaptureElement) {
+    c.Format = FormatPNG
+  }
+}
+
+// name是否重复由Rule.Validate检查，loop表示规则是否有loop
+func (c *Capture) validate(v *validator, loop bool, path ...interface{}) {
+  if c.Name == "" {
+    v.add("name is required", sub(path, "name")...)
+  }
+  switch c.Type {
+  case CaptureScreenshot, CaptureElement, CapturePDF, CaptureMHTML:
+  default:
+    v.add(fmt.Sprintf("unknown type %q", c.Type), sub(path, "type")...)
+  }
+  switch c.Stage {
+  case "", CaptureAfterPrepare, CaptureAfterFields:
+  case CaptureEachLoop:
+    if !loop {
+      v.add("stage loop requires loop", sub(path, "stage")...)
+    }
+  default:
+    v.add(fmt.Sprintf("unknown stage %q", c.Stage), sub(path, "stage")...)
+  }
+  image := c.Type == CaptureScreenshot || c.Type == CaptureElement
+  switch {
+  case c.Format != "" && !image:
+    v.add("format requires type screenshot or element", sub(path, "format")...)
+  case c.Format != "" && c.Format != FormatPNG && c.Format != FormatJPEG:
+    v.add(fmt.Sprintf("unknown format %q", c.Format), sub(path, "format")...)
+  }
+  if c.Quality != 0 && (c.Format != FormatJPEG || c.Quality < 1 || c.Quality > 100) {
+    v.add("quality must be in [1, 100] and requires format jpeg", sub(path, "quality")...)
+  }
+  if c.FullPage && c.Type != CaptureScreenshot {
+    v.add("full_page requires type screenshot", sub(path, "full_page")...)
+  }
+  if c.Selector != "" && c.Xpath != "" {
+    v.add("selector and xpath are exclusive", sub(path, "xpath")...)
+  } else if (c.Selector != "" || c.Xpath != "") != (c.Type == CaptureElement) {
+    v.add("selector or xpath is required by (and only by) type element", sub(path, "selector")...)
+  }
+  if c.Landscape && c.Type != CapturePDF {
+    v.add("landscape requires type pdf", sub(path, "landscape")...)
+  }
+}
+
+// Handler可以选择实现该接口，用于接收规则中capture的结果，
+// 在采集的goroutine中回调（与OnFields、OnLoop相同）
+type CaptureHandler interface {
+  OnCapture(*Page, *Snapshot)
+}
+
+// capture的结果
+type Snapshot struct {
+  // Capture.Name、Type、Stage
+  Name  string
+  Type  string
+  Stage string
+
+  // MIME类型：image/png、image/jpeg、application/pdf或multipart/related（MHTML）
+  ContentType string
+
+  Data []byte
+
+  // 截取时页面的URL
+  Url string
+
+  // 循环次数（loop），其它阶段为0
+  LoopCount int
+
+  // 截图的大小（CSS像素），pdf和mhtml为0
+  Width  float64
+  Height float64
+
+  Time time.Time
+}
+
+// Handler实现的CaptureHandler，Crawler包装的Handler以被包装的为准
+func captureHandlerOf(h Handler) CaptureHandler {
+  if ch, ok := h.(*crawlHandler); ok {
+    h = ch.h
+  }
+  if ch, ok := h.(CaptureHandler); ok {
+    return ch
+  }
+  return nil
+}
+
+// 执行stage阶段的capture并回调，出错时报告StageCapture并继续
+func (p *Page) capture(stage string, loopCount int) {
+  p.deliver(p.snapshots(stage, loopCount))
+}
+
+// 执行stage阶段的capture（Handler没有实现CaptureHandler时不执行）
+func (p *Page) snapshots(stage string, loopCount int) []*Snapshot {
+  if captureHandlerOf(p.handler) == nil {
+    return nil
+  }
+  var ret []*Snapshot
+  for _, c := range p.Rule.Captures {
+    if c.Stage != stage || p.ctx.Err() != nil {
+      continue
+    }
+    s, e := p.snapshot(c)
+    if e != nil {
+      p.report(StageCapture, c.Name, e)
+      continue
+    }
+    s.LoopCount = loopCount
+    ret = append(ret, s)
+  }
+  return ret
+}
+
+func (p *Page) deliver(snapshots []*Snapshot) {
+  if ch := captureHandlerOf(p.handler); ch != nil {
+    for _, s := range snapshots {
+      ch.OnCapture(p, s)
+    }
+  }
+}
+
+func (p *Page) snapshot(c *Capture) (*Snapshot, error) {
+  s := &Snapshot{Name: c.Name, Type: c.Type, Stage: c.Stage, Time: time.Now()}
+  msg, e := p.eval(map[string]interface{}{"expression": "location.href", "returnByValue": true})
+  if e != nil {
+    return nil, e
+  }
+  s.Url = conv.String(resultValue(msg), "")
+  var method string
+  var params map[string]interface{}
+  switch c.Type {
+  case CaptureScreenshot, CaptureElement:
+    method = pageCaptureScreenshot
+    params = map[string]interface{}{"format": c.Format}
+    if c.Format == FormatJPEG && c.Quality > 0 {
+      params["quality"] = c.Quality
+    }
+    var clip map[string]interface{}
+    if c.Type == CaptureElement {
+      clip, e = p.elementClip(c.Selector, c.Xpath)
+    } else if c.FullPage {
+      clip, e = p.pageClip()
+    }
+    if e != nil {
+      return nil, e
+    }
+    if clip != nil {
+      params["clip"] = clip
+      params["captureBeyondViewport"] = true
+      s.Width, _ = clip["width"].(float64)
+      s.Height, _ = clip["height"].(float64)
+    }
+    s.ContentType = "image/" + c.Format
+  case CapturePDF:
+    method = pagePrintToPDF
+    params = map[string]interface{}{"printBackground": true, "landscape": c.Landscape}
+    s.ContentType = "application/pdf"
+  case CaptureMHTML:
+    method = pageCaptureSnapshot
+    params = map[string]interface{}{"format": "mhtml"}
+    s.ContentType = "multipart/related"
+  }
+  if msg, e = p.call(method, params); e != nil {
+    return nil, e
+  }
+  data := conv.GetString(msg.Result, "data", "")
+  if c.Type == CaptureMHTML {
+    s.Data = []byte(data)
+  } else if s.Data, e = base64.StdEncoding.DecodeString(data); e != nil {
+    return nil, e
+  }
+  return s, nil
+}
+
+// 整个页面的大小
+func (p *Page) pageClip() (map[string]interface{}, error) {
+  msg, e := p.call(pageGetLayoutMetrics, nil)
+  if e != nil {
+    return nil, e
+  }
+  size := conv.GetMap(msg.Result, "cssContentSize")
+  if size == nil {
+    size = conv.GetMap(msg.Result, "contentSize")
+  }
+  w, _ := size["width"].(float64)
+  h, _ := size["height"].(float64)
+  return map[string]interface{}{"x": 0, "y": 0, "width": w, "height": h, "scale": 1}, nil
+}
+
+// 元素在页面中的位置和大小，没有匹配的元素时返回*SelectorError
+func (p *Page) elementClip(selector, xpath string) (map[string]interface{}, error) {
+  msg, e := p.eval(map[string]interface{}{
+    "expression": "(()=>{let e=" + queryNodes(selector, xpath) + "[0];if(!e||!e.getBoundingClientRect)return null;" +
+      "let r=e.getBoundingClientRect();return {x:r.left+window.scrollX,y:r.top+window.scrollY,width:r.width,height:r.height};})()",
+    "returnByValue": true,
+  })
+  if e != nil {
+    return nil, e
+  }
+  v, ok := resultValue(msg).(map[string]interface{})
+  if !ok {
+    if selector == "" {
+      selector = xpath
+    }
+    return nil, &SelectorError{Selector: selector}
+  }
+  v["scale"] = 1
+  return v, nil
+}
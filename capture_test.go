@@ -0,0 +1,252 @@
+package collector
+
+import (
+  "context"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+var captureRule = `id: "cap"
+group: "g"
+patterns: ["example.com"]
+capture:
+  - name: "full"
+    type: "screenshot"
+    full_page: true
+  - name: "price"
+    type: "element"
+    selector: "#price"
+    format: "jpeg"
+    quality: 80
+    stage: "prepare"
+  - name: "missing"
+    type: "element"
+    selector: "#missing"
+    stage: "prepare"
+  - name: "pdf"
+    type: "pdf"
+  - name: "mhtml"
+    type: "mhtml"
+  - name: "row"
+    type: "screenshot"
+    stage: "loop"
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+loop:
+  name: "l"
+  export_cycle: 1
+  eval: "cdp_loop_count"
+  next: "cdp_loop_count<2"
+`
+
+// 记录capture的结果和顺序（OnFields和OnLoop也记录在events中）
+type captureHandler struct {
+  done      chan struct{}
+  mu        sync.Mutex
+  events    []string
+  snapshots map[string]*Snapshot
+  errs      map[string]error
+}
+
+func (h *captureHandler) add(event string) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.events = append(h.events, event)
+}
+
+func (h *captureHandler) OnFields(p *Page, data Record) {
+  h.add("fields")
+}
+
+func (h *captureHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  h.add("loop")
+  return true
+}
+
+func (h *captureHandler) OnComplete(p *Page) {
+  close(h.done)
+}
+
+func (h *captureHandler) OnCapture(p *Page, s *Snapshot) {
+  h.add(s.Name)
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.snapshots[s.Name] = s
+}
+
+func (h *captureHandler) OnError(p *Page, stage Stage, name string, e error) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  if stage == StageCapture {
+    h.errs[name] = e
+  }
+}
+
+func TestCapture(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(captureRule)); e != nil {
+    t.Fatal(e)
+  }
+  evalFunc := func(expr string) interface{} {
+    switch {
+    case expr == "location.href":
+      return "http://example.com/1"
+    case strings.Contains(expr, `"#price"`):
+      return map[string]interface{}{"x": 10.0, "y": 20.0, "width": 100.0, "height": 30.0}
+    case strings.Contains(expr, `"#missing"`):
+      return nil
+    case strings.Contains(expr, "cdp_loop_count<2"):
+      return "false"
+    }
+    return "true"
+  }
+  p := NewPage("http://example.com/1", "g")
+  h := &captureHandler{done: make(chan struct{}), snapshots: make(map[string]*Snapshot), errs: make(map[string]error)}
+  if e := p.collect(context.Background(), fakeNewTab(evalFunc), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  want := "price,full,pdf,mhtml,fields,row,loop"
+  if got := strings.Join(h.events, ","); got != want {
+    t.Fatalf("want %s, got %s", want, got)
+  }
+  if _, ok := h.errs["missing"].(*SelectorError); !ok || len(h.errs) != 1 {
+    t.Fatalf("unexpected errors %v", h.errs)
+  }
+  cases := map[string]struct {
+    contentType, data string
+    width, height     float64
+  }{
+    "full":  {"image/png", "png", 1280, 4000},
+    "price": {"image/jpeg", "jpeg", 100, 30},
+    "pdf":   {"application/pdf", "%PDF", 0, 0},
+    "mhtml": {"multipart/related", "MIME-Version: 1.0", 0, 0},
+    "row":   {"image/png", "png", 0, 0},
+  }
+  for name, c := range cases {
+    s := h.snapshots[name]
+    if s.ContentType != c.contentType || string(s.Data) != c.data || s.Width != c.width || s.Height != c.height {
+      t.Errorf("%s: unexpected %s %q %v %v", name, s.ContentType, s.Data, s.Width, s.Height)
+    }
+    if s.Url != "http://example.com/1" || s.Time.IsZero() {
+      t.Errorf("%s: unexpected metadata %q %v", name, s.Url, s.Time)
+    }
+  }
+  if h.snapshots["row"].LoopCount != 1 || h.snapshots["row"].Stage != CaptureEachLoop || h.snapshots["full"].LoopCount != 0 {
+    t.Fatal("unexpected loop count or stage")
+  }
+}
+
+func TestValidateCapture(t *testing.T) {
+  data := []byte(`id: "cap"
+group: "g"
+patterns: ["example.com"]
+capture:
+  - type: "video"
+    stage: "never"
+  - name: "a"
+    type: "pdf"
+    format: "png"
+    quality: 80
+    full_page: true
+    selector: "p"
+  - name: "a"
+    type: "element"
+    stage: "loop"
+  - name: "b"
+    type: "screenshot"
+    format: "gif"
+    landscape: true
+fields:
+  - name: "a"
+    eval: "1"
+`)
+  _, e := ParseRule(data)
+  ve, ok := e.(*ValidationError)
+  if !ok {
+    t.Fatalf("want *ValidationError, got %v", e)
+  }
+  // 0: name, type, stage; 1: format, quality, full_page, selector; 2: duplicate, loop, selector; 3: format, landscape
+  if len(ve.Problems) != 12 {
+    t.Fatalf("want 12 problems, got %d: %v", len(ve.Problems), ve)
+  }
+}
+
+func TestCaptureHandlerOf(t *testing.T) {
+  h := &captureHandler{}
+  if captureHandlerOf(&recordHandler{}) != nil || captureHandlerOf(h) != h {
+    t.Fatal("unexpected capture handler")
+  }
+  // Crawler包装的Handler
+  if captureHandlerOf(&crawlHandler{h: &recordHandler{}}) != nil || captureHandlerOf(&crawlHandler{h: h}) != h {
+    t.Fatal("unexpected wrapped capture handler")
+  }
+}
+
+// xpath匹配的元素截图，重试时只回调最后一次尝试的prepare截图
+func TestCaptureRetry(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(`id: "cap"
+group: "g"
+patterns: ["example.com"]
+capture:
+  - name: "price"
+    type: "element"
+    xpath: "//p"
+    stage: "prepare"
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+retry:
+  max_attempts: 2
+  backoff: "1ms"
+  required: ["a"]
+`)); e != nil {
+    t.Fatal(e)
+  }
+  var tabs int32
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    n := atomic.AddInt32(&tabs, 1)
+    return newFakeTab(h, func(expr string) interface{} {
+      switch {
+      case strings.Contains(expr, `document.evaluate("//p"`):
+        return map[string]interface{}{"x": 0.0, "y": 0.0, "width": float64(n), "height": 1.0}
+      case strings.Contains(expr, "document.title") && n == 1:
+        return ""
+      }
+      return "ok"
+    }), nil
+  }
+  p := NewPage("http://example.com/1", "g")
+  h := &captureHandler{done: make(chan struct{}), snapshots: make(map[string]*Snapshot), errs: make(map[string]error)}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  if got := strings.Join(h.events, ","); tabs != 2 || got != "price,fields" {
+    t.Fatalf("want price,fields in 2 tabs, got %s in %d tabs", got, tabs)
+  }
+  if h.snapshots["price"].Width != 2 {
+    t.Fatalf("want snapshot of attempt 2, got width %v", h.snapshots["price"].Width)
+  }
+}
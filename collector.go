@@ -1,30 +1,53 @@
 package collector
 
 import (
+  "context"
   "errors"
-  "fmt"
   "html"
-  "strconv"
   "sync"
   "time"
 
   "github.com/kwf2030/cdp"
   "github.com/kwf2030/commons/base"
+  "github.com/kwf2030/commons/conv"
 )
 
-var ErrNoRuleMatched = errors.New("no rule matched")
+// 加载超时时发给attempt的事件（不是CDP事件，不会与页面的事件混淆）
+const loadTimeoutEvent = "collector.loadTimeout"
+
+var (
+  ErrNoRuleMatched = errors.New("no rule matched")
+  ErrTabClosed     = errors.New("tab closed")
+)
 
 type Handler interface {
-  // 只会回调一次，所有字段一次性返回
-  OnFields(*Page, map[string]string)
+  // 只会回调一次，所有导出（export: true）的字段一次性返回，
+  // 值的类型由Field.Type决定（默认为string）
+  OnFields(*Page, Record)
 
-  // 按设置的导出周期回调（如export_cycle=5表示5次循环回调1次），返回值表示是否继续循环
-  OnLoop(*Page, int, []string) bool
+  // 按设置的导出周期回调（如export_cycle=5表示5次循环回调1次），返回值表示是否继续循环，
+  // 值的类型由Loop.Type决定（默认为string）
+  OnLoop(*Page, int, []interface{}) bool
 
   // 在OnFields和OnLoop完成后调用
   OnComplete(*Page)
 }
 
+// Handler可以选择实现该接口，用于接收采集过程中的错误，
+// 第二个参数是出错的阶段，第三个参数是字段名（field阶段）或循环名（loop阶段），其它阶段为空，
+// 错误可能是ErrPrepareFailed、ErrLoadTimeout、ErrCallFailed（或*CallError）、ErrTabClosed、*EvalError、*NavigateError或*EnvError（navigate阶段，规则引用的环境变量不存在）
+type ErrorHandler interface {
+  OnError(*Page, Stage, string, error)
+}
+
+// *cdp.Tab实现了该接口，测试时可以用假的Tab代替浏览器
+type cdpTab interface {
+  Call(string, map[string]interface{}) (int32, chan *cdp.Message)
+  Fire(string, map[string]interface{})
+  Subscribe(...string)
+  Close()
+}
+
 type Page struct {
   Url string
 
@@ -33,11 +56,64 @@ type Page struct {
 
   Rule *Rule
 
-  tab *cdp.Tab
+  // 循环从第几次开始（cdp_loop_count的初始值，默认为1），用于恢复中断的循环，
+  // 在loop的prepare之前已经声明了cdp_loop_count，prepare中可以据此跳转（如直接打开第N页）
+  LoopStart int
+
+  // 为true时会保留未导出（export: false）字段的eval结果，
+  // 可以通过Unexported()获取，用于调试规则
+  Debug bool
+
+  // 覆盖规则的请求头、cookies和UA（用于每个任务不同的值），
+  // 请求头按名称覆盖，cookies在规则的之后设置
+  Headers   map[string]string
+  Cookies   []*Cookie
+  UserAgent string
+
+  // 未导出字段的eval结果（仅Debug时）
+  unexported Record
+
+  // 被拦截的请求数
+  blocked BlockStats
+
+  // 登录状态，多个Page可以共用，为nil表示不使用
+  Session *Session
+
+  // 覆盖规则和分组的代理设置，每次尝试从中分配代理
+  ProxyPool *ProxyPool
+
+  // 当前的Tab（重试时会打开新的Tab）
+  tab cdpTab
 
   handler Handler
 
-  once sync.Once
+  addr   string
+  rg     *RuleGroup
+  newTab func(cdp.Handler) (cdpTab, error)
+
+  // 在独立的BrowserContext中打开Tab（isolated或使用代理时），第二个参数是代理
+  newContext func(cdp.Handler, string) (cdpTab, error)
+
+  // 是否已经重新登录过（每个Page最多一次）
+  relogin bool
+
+  // 当前的尝试
+  attempt *attempt
+
+  // 之前每次尝试的失败（用于RetryError）
+  failures []error
+
+  // 由CollectContext传入的ctx派生，导航失败时也会取消
+  ctx    context.Context
+  cancel context.CancelFunc
+
+  // 采集结束时关闭
+  done     chan struct{}
+  complete sync.Once
+
+  // 采集中止的原因（只保留第一个）
+  err error
+  mu  sync.Mutex
 }
 
 func NewPage(url, group string) *Page {
@@ -47,105 +123,445 @@ func NewPage(url, group string) *Page {
   return &Page{Url: url, Group: group}
 }
 
-func (p *Page) OnCdpEvent(msg *cdp.Message) {
-  if msg.Method == cdp.Page.LoadEventFired {
-    // 如果超时，就有可能存在两次回调（超时一次回调和正常一次回调），
-    // once是为了防止重复调用
-    p.once.Do(func() {
-      m := p.collectFields()
-      if p.handler != nil {
-        p.handler.OnFields(p, m)
-      }
-      if p.Rule.Loop != nil {
-        p.collectLoop()
-      }
-      if p.handler != nil {
-        p.handler.OnComplete(p)
-      }
-    })
+func (p *Page) Close() {
+  p.mu.Lock()
+  tab := p.tab
+  p.mu.Unlock()
+  if tab != nil {
+    tab.Close()
   }
 }
 
-func (p *Page) OnCdpResponse(msg *cdp.Message) bool {
-  return false
+func (p *Page) current() *attempt {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return p.attempt
 }
 
-func (p *Page) Close() {
-  if p.tab != nil {
-    p.tab.Close()
+// 返回采集中止的原因（ctx取消或超时、导航失败），正常完成返回nil，
+// 在Handler.OnComplete中调用可以区分是否被取消
+func (p *Page) Err() error {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  return p.err
+}
+
+// 返回未导出字段的eval结果（仅在Debug为true时有值），
+// 应在OnFields或之后调用
+func (p *Page) Unexported() Record {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  ret := make(Record, len(p.unexported))
+  for k, v := range p.unexported {
+    ret[k] = v
+  }
+  return ret
+}
+
+func (p *Page) setUnexported(name string, value interface{}) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if p.unexported == nil {
+    p.unexported = make(Record, 4)
+  }
+  p.unexported[name] = value
+}
+
+func (p *Page) setErr(e error) {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if p.err == nil {
+    p.err = e
   }
 }
 
 func (p *Page) Collect(chrome *cdp.Chrome, rg *RuleGroup, h Handler) error {
-  if p.Url == "" {
+  return p.CollectContext(context.Background(), chrome, rg, h)
+}
+
+// ctx取消后会在两次eval之间停止采集，关闭Tab，
+// 然后回调Handler.OnComplete（此时Page.Err()返回ctx.Err()）
+func (p *Page) CollectContext(ctx context.Context, chrome *cdp.Chrome, rg *RuleGroup, h Handler) error {
+  if ctx == nil || p.Url == "" {
     return base.ErrInvalidArgument
   }
+  if e := ctx.Err(); e != nil {
+    return e
+  }
+  p.newContext = chromeContext(chrome)
+  return p.collect(ctx, func(h cdp.Handler) (cdpTab, error) {
+    tab, e := chrome.NewTab(h)
+    if e != nil {
+      return nil, e
+    }
+    return tab, nil
+  }, rg, h)
+}
+
+// Page匹配到的Rule在采集过程中不会改变（即使RuleGroup中的规则被替换）
+func (p *Page) collect(ctx context.Context, newTab func(cdp.Handler) (cdpTab, error), rg *RuleGroup, h Handler) error {
   addr := html.UnescapeString(p.Url)
   rule := rg.match(addr)
   if rule == nil {
     return ErrNoRuleMatched
   }
-  tab, e := chrome.NewTab(p)
+  p.Rule = rule
+  p.handler = h
+  p.addr = addr
+  p.rg = rg
+  p.newTab = newTab
+  p.ctx, p.cancel = context.WithCancel(ctx)
+  p.done = make(chan struct{})
+  if e := p.start(1); e != nil {
+    p.cancel()
+    return e
+  }
+  if ctx.Done() != nil {
+    go p.watch(ctx)
+  }
+  return nil
+}
+
+// 打开新的Tab，开始第n次尝试
+func (p *Page) start(n int) error {
+  if e := p.ctx.Err(); e != nil {
+    return e
+  }
+  a := &attempt{p: p, n: n, started: time.Now()}
+  var e error
+  if a.proxy, a.pool, e = p.proxy(); e != nil {
+    return e
+  }
+  var tab cdpTab
+  if a.proxy != "" || p.Rule.Isolated || (p.rg != nil && p.rg.Isolated()) {
+    if p.newContext == nil {
+      return ErrNoBrowserContext
+    }
+    tab, e = p.newContext(a, a.proxy)
+  } else {
+    tab, e = p.newTab(a)
+  }
   if e != nil {
     return e
   }
-  p.Rule = rule
+  a.tab = tab
+  // 超时后仍按加载完成处理（正常加载完成时取消）
+  a.timeout = timers.afterFunc(p.Rule.timeout, func() {
+    tab.Fire(loadTimeoutEvent, nil)
+  })
+  p.mu.Lock()
+  p.attempt = a
   p.tab = tab
-  p.handler = h
+  p.mu.Unlock()
   tab.Subscribe(cdp.Page.LoadEventFired)
   tab.Call(cdp.Page.Enable, nil)
-  tab.Call(cdp.Page.Navigate, map[string]interface{}{"url": addr})
-  // todo 如果定时器数量很大会有性能问题（改用时间轮）
-  time.AfterFunc(p.Rule.timeout, func() {
-    tab.Fire(cdp.Page.LoadEventFired, nil)
-  })
+  if events, lifecycle := p.Rule.Trigger.events(); len(events) > 0 {
+    tab.Subscribe(events...)
+    if lifecycle {
+      tab.Call(setLifecycleEventsEnabled, map[string]interface{}{"enabled": true})
+    }
+  }
+  if p.Rule.network {
+    a.network = newNetwork()
+  }
+  if len(p.Rule.Responses) > 0 {
+    a.captures = newCaptures(p.Rule.Responses)
+  }
+  a.block()
+  if p.Session != nil {
+    p.Session.apply(tab)
+  }
+  if n == 1 {
+    p.checkEnv()
+  }
+  p.applyHeaders(tab)
+  p.notify(StageNavigate, "", p.emulate(tab))
+  if a.network != nil || a.captures != nil {
+    tab.Subscribe(cdp.Network.RequestWillBeSent, cdp.Network.ResponseReceived, cdp.Network.LoadingFinished, cdp.Network.LoadingFailed)
+    tab.Call(cdp.Network.Enable, nil)
+  }
+  _, ch := tab.Call(cdp.Page.Navigate, map[string]interface{}{"url": p.addr})
+  go p.navigated(a, ch)
   return nil
 }
 
-func (p *Page) collectFields() map[string]string {
+// 检查Page.navigate的结果，失败则重试或中止采集
+func (p *Page) navigated(a *attempt, ch chan *cdp.Message) {
+  var e error
+  if ch == nil {
+    e = ErrTabClosed
+  } else {
+    select {
+    case msg := <-ch:
+      if e = checkResult(msg); e == nil {
+        if text := conv.GetString(msg.Result, "errorText", ""); text != "" {
+          e = &NavigateError{Url: p.addr, Text: text}
+        } else if a.navigated(conv.GetString(msg.Result, "frameId", ""), conv.GetString(msg.Result, "loaderId", "")) {
+          a.load()
+        }
+      }
+    case <-p.done:
+      return
+    }
+  }
+  if e != nil {
+    a.proxyResult(e)
+    p.reportTo(a, StageNavigate, "", e)
+    a.once.Do(func() {
+      if p.retry(a) {
+        return
+      }
+      // 重试次数用完时与其它失败一致（Err()返回*RetryError，OnFields仍会回调），
+      // 不重试导航失败时中止采集
+      if r := p.Rule.Retry; r == nil || a.failure(r) == nil {
+        p.stop(e)
+      }
+      p.run(a)
+    })
+  }
+}
+
+func (p *Page) watch(ctx context.Context) {
+  select {
+  case <-p.done:
+  case <-ctx.Done():
+    p.abort(ctx.Err())
+  }
+}
+
+// 中止采集，关闭Tab后正在等待的eval会立即返回，
+// 如果页面还未加载完成，直接结束采集
+func (p *Page) abort(e error) {
+  p.stop(e)
+  a := p.current()
+  a.once.Do(func() {
+    p.run(a)
+  })
+}
+
+func (p *Page) stop(e error) {
+  p.setErr(e)
+  p.cancel()
+  p.Close()
+}
+
+func (p *Page) isDone() bool {
+  select {
+  case <-p.done:
+    return true
+  default:
+    return false
+  }
+}
+
+// 每次尝试只会调用一次
+func (p *Page) run(a *attempt) {
+  timers.stop(a.timeout)
+  if p.current() != a {
+    return
+  }
+  if p.ctx.Err() == nil {
+    p.reportTo(a, StageLoad, "", p.waitTrigger(a))
+    // 超时已经在OnCdpEvent中计为代理失败
+    a.proxyResult(nil)
+    if p.checkLogin(a) {
+      return
+    }
+  }
+  if p.ctx.Err() == nil {
+    m := p.collectFields()
+    if p.ctx.Err() == nil {
+      p.checkRequired(m)
+      if p.retry(a) {
+        return
+      }
+      p.checkAttempts(a)
+      p.deliver(a.prepared)
+      p.capture(CaptureAfterFields, 0)
+      if a.proxy != "" {
+        m[RecordProxy] = a.proxy
+      }
+      if p.handler != nil {
+        p.handler.OnFields(p, m)
+      }
+    }
+  }
+  if p.Rule.Loop != nil && p.ctx.Err() == nil {
+    p.collectLoop()
+  }
+  p.finish()
+}
+
+// 结束采集，回调Handler.OnComplete
+func (p *Page) finish() {
+  p.complete.Do(func() {
+    if a := p.current(); a != nil {
+      timers.stop(a.timeout)
+    }
+    defer close(p.done)
+    defer p.cancel()
+    if e := p.ctx.Err(); e != nil {
+      p.setErr(e)
+      p.Close()
+    }
+    if p.handler != nil {
+      p.handler.OnComplete(p)
+    }
+  })
+}
+
+// 如果Handler实现了ErrorHandler则回调，
+// ctx取消导致的错误不回调（通过Page.Err()获取）
+func (p *Page) report(stage Stage, name string, e error) {
+  p.reportTo(p.current(), stage, name, e)
+}
+
+// 记录到第a次尝试的错误中（用于判断是否需要重试）并回调
+func (p *Page) reportTo(a *attempt, stage Stage, name string, e error) {
+  if e == nil || p.ctx.Err() != nil {
+    return
+  }
+  a.fail(stage, e)
+  if h, ok := p.handler.(ErrorHandler); ok {
+    h.OnError(p, stage, name, e)
+  }
+}
+
+// 回调OnError但不记录到尝试的错误中（不会因此重试），用于重试也不能解决的问题
+func (p *Page) notify(stage Stage, name string, e error) {
+  if e == nil || p.ctx.Err() != nil {
+    return
+  }
+  if h, ok := p.handler.(ErrorHandler); ok {
+    h.OnError(p, stage, name, e)
+  }
+}
+
+// 执行表达式并等待结果，ctx取消时立即返回，
+// 返回的错误可能是ctx.Err()、ErrTabClosed、ErrCallFailed或*EvalError
+func (p *Page) eval(params map[string]interface{}) (*cdp.Message, error) {
+  return p.call(cdp.Runtime.Evaluate, params)
+}
+
+// 调用方法并等待结果，ctx取消时立即返回
+func (p *Page) call(method string, params map[string]interface{}) (*cdp.Message, error) {
+  if e := p.ctx.Err(); e != nil {
+    return nil, e
+  }
+  _, ch := p.tab.Call(method, params)
+  if ch == nil {
+    return nil, ErrTabClosed
+  }
+  select {
+  case msg := <-ch:
+    return msg, checkResult(msg)
+  case <-p.ctx.Done():
+    return nil, p.ctx.Err()
+  }
+}
+
+// 等待d时间，ctx取消时立即返回
+func (p *Page) sleep(d time.Duration) error {
+  if d <= 0 {
+    return p.ctx.Err()
+  }
+  ch := make(chan struct{})
+  t := timers.afterFunc(d, func() {
+    close(ch)
+  })
+  select {
+  case <-ch:
+    return nil
+  case <-p.ctx.Done():
+    timers.stop(t)
+    return p.ctx.Err()
+  }
+}
+
+// 检查返回值类型后执行transforms
+func (p *Page) convert(typ string, transforms []TransformFunc, v interface{}) (interface{}, error) {
+  v, e := convertValue(typ, v)
+  if e != nil {
+    return nil, e
+  }
+  return applyTransforms(transforms, v)
+}
+
+func (p *Page) collectFields() Record {
   rule := p.Rule
-  ret := make(map[string]string, len(rule.Fields))
-  params := map[string]interface{}{"objectGroup": "console", "includeCommandLineAPI": true}
+  ret := make(Record, len(rule.Fields))
+  params := map[string]interface{}{"objectGroup": "console", "includeCommandLineAPI": true, "returnByValue": true}
   if rule.Prepare != nil {
-    if rule.Prepare.Eval != "" {
-      if rule.Prepare.Eval[0] == '{' {
-        params["expression"] = rule.Prepare.Eval
-      } else {
-        params["expression"] = "{" + rule.Prepare.Eval + "}"
+    href := p.href(rule.Prepare.WaitFor)
+    if rule.Prepare.expr != "" {
+      params["expression"] = rule.Prepare.expr
+      msg, e := p.eval(params)
+      if e == nil && msg.GetResultValue() != "true" {
+        e = ErrPrepareFailed
       }
-      _, ch := p.tab.Call(cdp.Runtime.Evaluate, params)
-      if msg := <-ch; msg.GetResultValue() != "true" {
+      if e != nil {
+        p.report(StagePrepare, "", e)
         return ret
       }
     }
-    if rule.Prepare.wait > 0 {
-      time.Sleep(rule.Prepare.wait)
+    if e := p.wait(rule.Prepare.wait, rule.Prepare.WaitFor, href); e != nil {
+      p.report(StagePrepare, "", e)
+      return ret
     }
   }
+  if a := p.current(); a != nil {
+    a.prepared = p.snapshots(CaptureAfterPrepare, 0)
+  }
   for _, field := range rule.Fields {
-    if field.Eval != "" {
-      if field.Value != "" {
-        params["expression"] = fmt.Sprintf("{let cdp_field_value='%s';%s}", field.Value, field.Eval)
+    href := p.href(field.WaitFor)
+    if field.expr != "" || field.Response != "" {
+      var rv interface{}
+      var e error
+      if field.Response != "" {
+        rv, e = p.responseValue(field.Response, field.All)
       } else {
-        if field.Eval[0] == '{' {
-          params["expression"] = field.Eval
-        } else {
-          params["expression"] = "{" + field.Eval + "}"
+        params["expression"] = field.expr
+        var msg *cdp.Message
+        if msg, e = p.eval(params); e == nil {
+          rv = resultValue(msg)
         }
       }
-      _, ch := p.tab.Call(cdp.Runtime.Evaluate, params)
-      msg := <-ch
-      r := msg.GetResultValue()
-      ret[field.Name] = r
-      params["expression"] = fmt.Sprintf("const cdp_field_%s='%s'", field.Name, r)
-      p.tab.Call(cdp.Runtime.Evaluate, params)
-    } else if field.Value != "" {
-      ret[field.Name] = field.Value
-      params["expression"] = fmt.Sprintf("const cdp_field_%s='%s'", field.Name, field.Value)
-      p.tab.Call(cdp.Runtime.Evaluate, params)
+      if e != nil {
+        p.report(StageField, field.Name, e)
+        if p.ctx.Err() != nil {
+          return ret
+        }
+      } else if field.query != "" && isSelectorNotFound(rv) {
+        p.report(StageField, field.Name, &SelectorError{Selector: field.Selector + field.Xpath})
+      } else if v, e := p.convert(field.Type, field.transforms, rv); e != nil {
+        p.report(StageField, field.Name, e)
+      } else if field.Export {
+        ret[field.Name] = v
+        params["expression"] = fieldVarExpr(field.Name, v)
+        p.tab.Call(cdp.Runtime.Evaluate, params)
+      } else if p.Debug {
+        p.setUnexported(field.Name, v)
+      }
+    } else if field.Value != "" && (field.Export || p.Debug) {
+      v, e := parseValue(field.Type, field.Value)
+      if e == nil {
+        v, e = applyTransforms(field.transforms, v)
+      }
+      if e != nil {
+        p.report(StageField, field.Name, e)
+      } else if field.Export {
+        ret[field.Name] = v
+        params["expression"] = fieldVarExpr(field.Name, v)
+        p.tab.Call(cdp.Runtime.Evaluate, params)
+      } else {
+        p.setUnexported(field.Name, v)
+      }
     }
-    if field.wait > 0 {
-      time.Sleep(field.wait)
+    if e := p.wait(field.wait, field.WaitFor, href); e != nil {
+      p.report(StageField, field.Name, e)
+      if p.ctx.Err() != nil {
+        return ret
+      }
     }
   }
   return ret
@@ -153,65 +569,93 @@ func (p *Page) collectFields() map[string]string {
 
 func (p *Page) collectLoop() {
   rule := p.Rule
-  params := map[string]interface{}{"objectGroup": "console", "includeCommandLineAPI": true}
+  params := map[string]interface{}{"objectGroup": "console", "includeCommandLineAPI": true, "returnByValue": true}
+  start := p.LoopStart
+  if start < 1 {
+    start = 1
+  }
+  params["expression"] = loopCountDeclExpr(start)
+  p.tab.Call(cdp.Runtime.Evaluate, params)
   if rule.Loop.Prepare != nil {
-    if rule.Loop.Prepare.Eval != "" {
-      if rule.Loop.Prepare.Eval[0] == '{' {
-        params["expression"] = rule.Loop.Prepare.Eval
-      } else {
-        params["expression"] = "{" + rule.Loop.Prepare.Eval + "}"
+    href := p.href(rule.Loop.Prepare.WaitFor)
+    if rule.Loop.Prepare.expr != "" {
+      params["expression"] = rule.Loop.Prepare.expr
+      msg, e := p.eval(params)
+      if e == nil && msg.GetResultValue() != "true" {
+        e = ErrPrepareFailed
       }
-      _, ch := p.tab.Call(cdp.Runtime.Evaluate, params)
-      if msg := <-ch; msg.GetResultValue() != "true" {
+      if e != nil {
+        p.report(StageLoopPrepare, rule.Loop.Name, e)
         return
       }
     }
-    if rule.Loop.Prepare.wait > 0 {
-      time.Sleep(rule.Loop.Prepare.wait)
+    if e := p.wait(rule.Loop.Prepare.wait, rule.Loop.Prepare.WaitFor, href); e != nil {
+      p.report(StageLoopPrepare, rule.Loop.Name, e)
+      return
     }
   }
-  if rule.Loop.Eval != "" && rule.Loop.Eval[0] != '{' {
-    rule.Loop.Eval = "{" + rule.Loop.Eval + "}"
-  }
-  if rule.Loop.Next != "" && rule.Loop.Next[0] != '{' {
-    rule.Loop.Next = "{" + rule.Loop.Next + "}"
-  }
-  i := 0
-  params["expression"] = "let cdp_loop_count=1;"
-  arr := make([]string, rule.Loop.ExportCycle)
+  i := start - 1
+  count := 0
+  arr := make([]interface{}, rule.Loop.ExportCycle)
   for {
     i++
-    n := i % rule.Loop.ExportCycle
-    if i > 1 {
-      params["expression"] = "cdp_loop_count=" + strconv.Itoa(i) + ";"
+    count++
+    n := count % rule.Loop.ExportCycle
+    if count > 1 {
+      params["expression"] = loopCountExpr(i)
+      p.tab.Call(cdp.Runtime.Evaluate, params)
     }
-    p.tab.Call(cdp.Runtime.Evaluate, params)
     // eval
-    if rule.Loop.Eval != "" {
-      params["expression"] = rule.Loop.Eval
-      _, ch := p.tab.Call(cdp.Runtime.Evaluate, params)
-      msg := <-ch
-      if n == 0 {
-        arr[rule.Loop.ExportCycle-1] = msg.GetResultValue()
+    if rule.Loop.eval != "" || rule.Loop.Response != "" {
+      var v interface{}
+      var e error
+      if rule.Loop.Response != "" {
+        v, e = p.loopResponse(rule.Loop.Response, rule.Loop.All)
       } else {
-        arr[n-1] = msg.GetResultValue()
+        params["expression"] = rule.Loop.eval
+        var msg *cdp.Message
+        if msg, e = p.eval(params); e == nil {
+          v = resultValue(msg)
+        }
+      }
+      if e == nil {
+        v, e = p.convert(rule.Loop.Type, rule.Loop.transforms, v)
+      }
+      if e != nil {
+        p.report(StageLoop, rule.Loop.Name, e)
+        if p.ctx.Err() != nil {
+          break
+        }
+      } else if n == 0 {
+        arr[rule.Loop.ExportCycle-1] = v
+      } else {
+        arr[n-1] = v
       }
     }
+    p.capture(CaptureEachLoop, i)
     if n == 0 {
       if p.handler != nil {
         if ok := p.handler.OnLoop(p, i, arr); !ok {
           break
         }
       }
-      for j := 0; j < rule.Loop.ExportCycle; j++ {
-        arr[j] = ""
-      }
+      // 不复用arr，Handler可以保留上一次的结果
+      arr = make([]interface{}, rule.Loop.ExportCycle)
     }
     // next
-    if rule.Loop.Next != "" {
-      params["expression"] = rule.Loop.Next
-      _, ch := p.tab.Call(cdp.Runtime.Evaluate, params)
-      if msg := <-ch; msg.GetResultValue() != "true" {
+    href := p.href(rule.Loop.WaitFor)
+    if rule.Loop.next != "" {
+      params["expression"] = rule.Loop.next
+      msg, e := p.eval(params)
+      if e != nil {
+        p.report(StageLoopNext, rule.Loop.Name, e)
+        // 已经eval的结果仍然回调（如最后一页点击下一页时抛出异常）
+        if p.handler != nil && n != 0 && p.ctx.Err() == nil {
+          p.handler.OnLoop(p, i, arr[:n])
+        }
+        break
+      }
+      if msg.GetResultValue() != "true" {
         if p.handler != nil && n != 0 {
           p.handler.OnLoop(p, i, arr[:n])
         }
@@ -219,8 +663,12 @@ func (p *Page) collectLoop() {
       }
     }
     // wait
-    if rule.Loop.wait > 0 {
-      time.Sleep(rule.Loop.wait)
+    if e := p.wait(rule.Loop.wait, rule.Loop.WaitFor, href); e != nil {
+      p.report(StageLoopNext, rule.Loop.Name, e)
+      if p.handler != nil && n != 0 && p.ctx.Err() == nil {
+        p.handler.OnLoop(p, i, arr[:n])
+      }
+      break
     }
   }
 }
@@ -0,0 +1,205 @@
+package collector
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+// 循环不会自己结束，只能由ctx中止
+var endlessRule = `id: "e"
+group: "g"
+patterns: ["example.com"]
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+loop:
+  name: "l"
+  eval: "cdp_loop_count"
+  next: "true"
+  wait: "5ms"
+`
+
+type ctxHandler struct {
+  loops     int32
+  completes int32
+  done      chan struct{}
+}
+
+func (h *ctxHandler) OnFields(p *Page, data Record) {
+}
+
+func (h *ctxHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  atomic.AddInt32(&h.loops, 1)
+  return true
+}
+
+func (h *ctxHandler) OnComplete(p *Page) {
+  if atomic.AddInt32(&h.completes, 1) == 1 {
+    close(h.done)
+  }
+}
+
+func TestCollectContext(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(endlessRule)); e != nil {
+    t.Fatal(e)
+  }
+  cases := []struct {
+    name string
+    ctx  func() (context.Context, context.CancelFunc)
+    want error
+  }{
+    {"cancel", func() (context.Context, context.CancelFunc) {
+      ctx, cancel := context.WithCancel(context.Background())
+      time.AfterFunc(time.Millisecond*300, cancel)
+      return ctx, cancel
+    }, context.Canceled},
+    {"deadline", func() (context.Context, context.CancelFunc) {
+      return context.WithTimeout(context.Background(), time.Millisecond*300)
+    }, context.DeadlineExceeded},
+  }
+  for _, c := range cases {
+    t.Run(c.name, func(t *testing.T) {
+      ctx, cancel := c.ctx()
+      defer cancel()
+      var tab *fakeTab
+      newTab := func(h cdp.Handler) (cdpTab, error) {
+        tab = newFakeTab(h, func(string) interface{} { return "true" })
+        return tab, nil
+      }
+      h := &ctxHandler{done: make(chan struct{})}
+      p := NewPage("http://example.com", "g")
+      if e := p.collect(ctx, newTab, rg, h); e != nil {
+        t.Fatal(e)
+      }
+      select {
+      case <-h.done:
+      case <-time.After(time.Second * 5):
+        t.Fatal("OnComplete not called")
+      }
+      // 等待可能的重复回调
+      time.Sleep(time.Millisecond * 50)
+      if n := atomic.LoadInt32(&h.completes); n != 1 {
+        t.Fatalf("OnComplete called %d times", n)
+      }
+      if atomic.LoadInt32(&h.loops) == 0 {
+        t.Fatal("aborted before loop")
+      }
+      if p.Err() != c.want {
+        t.Fatalf("want %v, got %v", c.want, p.Err())
+      }
+      if atomic.LoadInt32(&tab.closed) == 0 {
+        t.Fatal("tab not closed")
+      }
+    })
+  }
+}
+
+var unexportedRule = `id: "u"
+group: "g"
+patterns: ["example.com"]
+fields:
+  - name: "a"
+    eval: "'exported'"
+    export: true
+  - name: "b"
+    eval: "'unexported'"
+  - name: "c"
+    value: "C"
+`
+
+func TestUnexported(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(unexportedRule)); e != nil {
+    t.Fatal(e)
+  }
+  eval := func(expr string) interface{} {
+    if strings.Contains(expr, "'unexported'") {
+      return "B"
+    }
+    return "A"
+  }
+  for _, debug := range []bool{false, true} {
+    h := &recordHandler{done: make(chan struct{})}
+    p := NewPage("http://example.com", "g")
+    p.Debug = debug
+    if e := p.collect(context.Background(), fakeNewTab(eval), rg, h); e != nil {
+      t.Fatal(e)
+    }
+    <-h.done
+    if len(h.record) != 1 || h.record["a"] != "A" {
+      t.Fatalf("debug %v: unexpected record %v", debug, h.record)
+    }
+    u := p.Unexported()
+    if debug && (len(u) != 2 || u["b"] != "B" || u["c"] != "C") {
+      t.Fatalf("unexpected unexported %v", u)
+    }
+    if !debug && len(u) != 0 {
+      t.Fatalf("want no unexported without debug, got %v", u)
+    }
+  }
+}
+
+var nextThrowsRule = `id: "n"
+group: "g"
+patterns: ["example.com"]
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+loop:
+  name: "l"
+  export_cycle: 10
+  eval: "'item'"
+  next: "document.querySelector('.next').click();true"
+`
+
+type batchHandler struct {
+  recordHandler
+  mu      sync.Mutex
+  batches [][]interface{}
+}
+
+func (h *batchHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.batches = append(h.batches, data)
+  return true
+}
+
+func TestLoopNextThrows(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(nextThrowsRule)); e != nil {
+    t.Fatal(e)
+  }
+  var nexts int32
+  eval := func(expr string) interface{} {
+    if !strings.Contains(expr, ".next") {
+      return "item"
+    }
+    // 第3次循环（最后一页）时抛出异常
+    if atomic.AddInt32(&nexts, 1) == 3 {
+      return errors.New("TypeError: Cannot read property 'click' of null")
+    }
+    return "true"
+  }
+  h := &batchHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  p := NewPage("http://example.com", "g")
+  if e := p.collect(context.Background(), fakeNewTab(eval), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  <-h.done
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  if len(h.batches) != 1 || len(h.batches[0]) != 3 {
+    t.Fatalf("want 1 batch of 3 items, got %v", h.batches)
+  }
+}
@@ -0,0 +1,314 @@
+package collector
+
+import (
+  "context"
+  "html"
+  "net/url"
+  "strings"
+  "sync"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/base"
+)
+
+// 任务状态
+const (
+  JobPending = iota
+  JobRunning
+  JobDone
+  JobFailed
+)
+
+// 采集任务
+type Job struct {
+  Url   string `json:"url"`
+  Group string `json:"group"`
+  State int    `json:"state"`
+
+  // 开始采集的次数
+  Attempts int `json:"attempts"`
+
+  // 失败的原因（JobFailed）
+  Err string `json:"err,omitempty"`
+
+  // 最后一次完成的循环次数（OnLoop回调时的循环次数），恢复时从下一次开始
+  LoopCount int `json:"loop_count,omitempty"`
+
+  // 最后一次采集使用的代理
+  Proxy string `json:"proxy,omitempty"`
+}
+
+func (j *Job) key() string {
+  return j.Group + " " + j.Url
+}
+
+// 管理采集队列，限制同时打开的Tab数和每个Host的并发数，
+// 已经加入过队列的URL（同一分组内）不会重复采集，
+// 采集完成后会自动关闭Tab，Handler中只需要调用Enqueue添加新发现的URL
+type Crawler struct {
+  ctx    context.Context
+  cancel context.CancelFunc
+
+  rs      *RuleSet
+  handler Handler
+  newTab  func(cdp.Handler) (cdpTab, error)
+
+  // 为nil时isolated或使用代理的页面会失败
+  newContext func(cdp.Handler, string) (cdpTab, error)
+
+  maxTabs    int
+  maxPerHost int
+
+  queue   []*Job
+  jobs    map[string]*Job
+  running int
+  hosts   map[string]int
+
+  store    Store
+  storeErr error
+
+  wg sync.WaitGroup
+  mu sync.Mutex
+}
+
+// maxTabs是最多同时打开的Tab数，maxPerHost是每个Host最多同时采集的页面数（小于等于0表示不限制），
+// ctx取消后正在采集的页面会中止，队列中的任务不再采集
+func NewCrawler(ctx context.Context, chrome *cdp.Chrome, rs *RuleSet, h Handler, maxTabs, maxPerHost int) *Crawler {
+  if ctx == nil || chrome == nil || rs == nil || maxTabs <= 0 {
+    return nil
+  }
+  c := newCrawler(ctx, func(h cdp.Handler) (cdpTab, error) {
+    tab, e := chrome.NewTab(h)
+    if e != nil {
+      return nil, e
+    }
+    return tab, nil
+  }, rs, h, maxTabs, maxPerHost)
+  c.newContext = chromeContext(chrome)
+  return c
+}
+
+func newCrawler(ctx context.Context, newTab func(cdp.Handler) (cdpTab, error), rs *RuleSet, h Handler, maxTabs, maxPerHost int) *Crawler {
+  c := &Crawler{
+    rs:         rs,
+    handler:    h,
+    newTab:     newTab,
+    maxTabs:    maxTabs,
+    maxPerHost: maxPerHost,
+    queue:      make([]*Job, 0, 64),
+    jobs:       make(map[string]*Job, 64),
+    hosts:      make(map[string]int, 8),
+  }
+  c.ctx, c.cancel = context.WithCancel(ctx)
+  return c
+}
+
+// 添加任务，返回false表示URL无效、已经添加过或Crawler已停止
+func (c *Crawler) Enqueue(addr, group string) bool {
+  if addr == "" || group == "" || c.ctx.Err() != nil {
+    return false
+  }
+  addr = html.UnescapeString(addr)
+  // 忽略锚点
+  if i := strings.IndexByte(addr, '#'); i != -1 {
+    addr = addr[:i]
+  }
+  job := &Job{Url: addr, Group: group, State: JobPending}
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if _, ok := c.jobs[job.key()]; ok {
+    return false
+  }
+  c.jobs[job.key()] = job
+  c.save(job)
+  c.wg.Add(1)
+  c.queue = append(c.queue, job)
+  c.schedule()
+  return true
+}
+
+// 从Store恢复任务（应在Enqueue之前调用），之后任务状态的变化都会保存到Store，
+// 未完成（JobPending和JobRunning）的任务会重新加入队列（有循环的从中断的位置继续），
+// 已完成和失败的任务不会再次采集
+func (c *Crawler) Restore(s Store) error {
+  if s == nil {
+    return base.ErrInvalidArgument
+  }
+  jobs, e := s.Jobs()
+  if e != nil {
+    return e
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.store = s
+  for _, job := range jobs {
+    c.jobs[job.key()] = job
+    if job.State == JobPending || job.State == JobRunning {
+      job.State = JobPending
+      c.wg.Add(1)
+      c.queue = append(c.queue, job)
+    }
+  }
+  c.schedule()
+  return nil
+}
+
+// 返回所有任务的状态
+func (c *Crawler) Jobs() []Job {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  ret := make([]Job, 0, len(c.jobs))
+  for _, job := range c.jobs {
+    ret = append(ret, *job)
+  }
+  return ret
+}
+
+// 返回第一次保存任务到Store时的错误
+func (c *Crawler) Err() error {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  return c.storeErr
+}
+
+// 保存任务，必须持有锁
+func (c *Crawler) save(job *Job) {
+  if c.store == nil {
+    return
+  }
+  if e := c.store.Put(job); e != nil && c.storeErr == nil {
+    c.storeErr = e
+  }
+}
+
+// 等待所有任务（包括采集过程中新添加的）完成
+func (c *Crawler) Wait() {
+  c.wg.Wait()
+}
+
+// 停止采集，正在采集的页面会中止（Page.Err()返回context.Canceled），队列中的任务会被丢弃
+func (c *Crawler) Stop() {
+  c.cancel()
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  c.schedule()
+}
+
+// 在满足并发限制的情况下启动队列中的任务，必须持有锁，
+// 已停止时丢弃队列中的任务
+func (c *Crawler) schedule() {
+  if c.ctx.Err() != nil {
+    for range c.queue {
+      c.wg.Done()
+    }
+    c.queue = c.queue[:0]
+    return
+  }
+  for i := 0; i < len(c.queue) && c.running < c.maxTabs; {
+    job := c.queue[i]
+    host := hostOf(job.Url)
+    if c.maxPerHost > 0 && c.hosts[host] >= c.maxPerHost {
+      i++
+      continue
+    }
+    c.queue = append(c.queue[:i], c.queue[i+1:]...)
+    c.running++
+    c.hosts[host]++
+    job.State = JobRunning
+    job.Attempts++
+    c.save(job)
+    go c.start(job, host, job.LoopCount+1)
+  }
+}
+
+func (c *Crawler) start(job *Job, host string, loopStart int) {
+  p := NewPage(job.Url, job.Group)
+  p.LoopStart = loopStart
+  p.newContext = c.newContext
+  var e error
+  if rg := c.rs.Group(job.Group); rg == nil {
+    e = ErrNoRuleMatched
+  } else {
+    e = p.collect(c.ctx, c.newTab, rg, &crawlHandler{c: c, h: c.handler, job: job, host: host})
+  }
+  if e != nil {
+    if eh, ok := c.handler.(ErrorHandler); ok {
+      eh.OnError(p, StageCollect, "", e)
+    }
+    c.finish(job, host, e)
+  }
+}
+
+func (c *Crawler) finish(job *Job, host string, e error) {
+  c.mu.Lock()
+  switch {
+  case e == nil:
+    job.State = JobDone
+    job.Err = ""
+  case c.ctx.Err() != nil:
+    // Crawler停止导致的中止，恢复时继续采集
+    job.State = JobPending
+  default:
+    job.State = JobFailed
+    job.Err = e.Error()
+  }
+  c.save(job)
+  c.running--
+  if c.hosts[host]--; c.hosts[host] <= 0 {
+    delete(c.hosts, host)
+  }
+  c.schedule()
+  c.mu.Unlock()
+  c.wg.Done()
+}
+
+func hostOf(addr string) string {
+  u, e := url.Parse(addr)
+  if e != nil {
+    return ""
+  }
+  return u.Host
+}
+
+// 包装Handler，采集完成后关闭Tab并调度下一个任务
+type crawlHandler struct {
+  c    *Crawler
+  h    Handler
+  job  *Job
+  host string
+}
+
+func (ch *crawlHandler) OnFields(p *Page, data Record) {
+  if ch.h != nil {
+    ch.h.OnFields(p, data)
+  }
+}
+
+func (ch *crawlHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  ok := true
+  if ch.h != nil {
+    ok = ch.h.OnLoop(p, i, data)
+  }
+  ch.c.mu.Lock()
+  ch.job.LoopCount = i
+  ch.c.save(ch.job)
+  ch.c.mu.Unlock()
+  return ok
+}
+
+func (ch *crawlHandler) OnComplete(p *Page) {
+  if ch.h != nil {
+    ch.h.OnComplete(p)
+  }
+  p.Close()
+  ch.c.mu.Lock()
+  ch.job.Proxy = p.Proxy()
+  ch.c.mu.Unlock()
+  ch.c.finish(ch.job, ch.host, p.Err())
+}
+
+func (ch *crawlHandler) OnError(p *Page, stage Stage, name string, e error) {
+  if eh, ok := ch.h.(ErrorHandler); ok {
+    eh.OnError(p, stage, name, e)
+  }
+}
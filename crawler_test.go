@@ -0,0 +1,90 @@
+package collector
+
+import (
+  "context"
+  "strconv"
+  "sync/atomic"
+  "testing"
+)
+
+var crawlRules = []byte(`id: "list"
+group: "list"
+patterns: ["list.com"]
+loop:
+  name: "urls"
+  export_cycle: 1
+  eval: "urls"
+  next: "true"
+---
+id: "detail"
+group: "detail"
+patterns: ["a.com", "b.com"]
+fields:
+  - name: "title"
+    eval: "document.title"
+    export: true
+`)
+
+type crawlTestHandler struct {
+  c       *Crawler
+  details int32
+}
+
+func (h *crawlTestHandler) OnFields(p *Page, data Record) {
+  if p.Group == "detail" {
+    atomic.AddInt32(&h.details, 1)
+  }
+}
+
+func (h *crawlTestHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  for j := 0; j < 5; j++ {
+    h.c.Enqueue("http://a.com/"+strconv.Itoa(i*10+j), "detail")
+    h.c.Enqueue("http://b.com/"+strconv.Itoa(i*10+j), "detail")
+  }
+  // 重复的URL
+  h.c.Enqueue("http://a.com/"+strconv.Itoa(i*10)+"#top", "detail")
+  return i < 3
+}
+
+func (h *crawlTestHandler) OnComplete(p *Page) {
+}
+
+func TestCrawler(t *testing.T) {
+  rs := NewRuleSet()
+  if e := rs.AppendBytes(crawlRules); e != nil {
+    t.Fatal(e)
+  }
+  h := &crawlTestHandler{}
+  var c *Crawler
+  var violations int32
+  c = newCrawler(context.Background(), fakeNewTab(func(string) interface{} {
+    // 每次eval时检查并发限制
+    c.mu.Lock()
+    if c.running > 3 {
+      atomic.AddInt32(&violations, 1)
+    }
+    for _, n := range c.hosts {
+      if n > 1 {
+        atomic.AddInt32(&violations, 1)
+      }
+    }
+    c.mu.Unlock()
+    return "true"
+  }), rs, h, 3, 1)
+  h.c = c
+  if !c.Enqueue("http://list.com/", "list") || c.Enqueue("http://list.com/", "list") {
+    t.Fatal("dedup failed")
+  }
+  c.Wait()
+  if violations > 0 {
+    t.Fatalf("concurrency limits violated %d times", violations)
+  }
+  if h.details != 30 {
+    t.Fatalf("want 30 detail pages, got %d", h.details)
+  }
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if c.running != 0 || len(c.queue) != 0 || len(c.hosts) != 0 {
+    t.Fatalf("unexpected state: running=%d queue=%d hosts=%v", c.running, len(c.queue), c.hosts)
+  }
+}
@@ -0,0 +1,226 @@
+package collector
+
+import (
+  "fmt"
+  "net/url"
+  "strings"
+
+  "github.com/kwf2030/cdp"
+)
+
+const (
+  emulationSetDeviceMetricsOverride   = "Emulation.setDeviceMetricsOverride"
+  emulationSetTouchEmulationEnabled   = "Emulation.setTouchEmulationEnabled"
+  emulationSetTimezoneOverride        = "Emulation.setTimezoneOverride"
+  emulationSetLocaleOverride          = "Emulation.setLocaleOverride"
+  emulationSetGeolocationOverride     = "Emulation.setGeolocationOverride"
+  emulationSetEmitTouchEventsForMouse = "Emulation.setEmitTouchEventsForMouse"
+  browserGrantPermissions             = "Browser.grantPermissions"
+)
+
+// 预设的设备（device），名称不区分大小写
+type device struct {
+  width     int
+  height    int
+  scale     float64
+  mobile    bool
+  touch     bool
+  userAgent string
+}
+
+var devices = map[string]*device{
+  "iphone se": {320, 568, 2, true, true,
+    "Mozilla/5.0 (iPhone; CPU iPhone OS 10_3_1 like Mac OS X) AppleWebKit/603.1.30 (KHTML, like Gecko) Version/10.0 Mobile/14E304 Safari/602.1"},
+  "iphone x": {375, 812, 3, true, true,
+    "Mozilla/5.0 (iPhone; CPU iPhone OS 11_0 like Mac OS X) AppleWebKit/604.1.38 (KHTML, like Gecko) Version/11.0 Mobile/15A372 Safari/604.1"},
+  "iphone 12 pro": {390, 844, 3, true, true,
+    "Mozilla/5.0 (iPhone; CPU iPhone OS 14_4 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/14.0.3 Mobile/15E148 Safari/604.1"},
+  "pixel 5": {393, 851, 2.75, true, true,
+    "Mozilla/5.0 (Linux; Android 11; Pixel 5) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/90.0.4430.91 Mobile Safari/537.36"},
+  "galaxy s9+": {320, 658, 4.5, true, true,
+    "Mozilla/5.0 (Linux; Android 8.0.0; SM-G965U Build/R16NW) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.111 Mobile Safari/537.36"},
+  "ipad": {768, 1024, 2, true, true,
+    "Mozilla/5.0 (iPad; CPU OS 11_0 like Mac OS X) AppleWebKit/604.1.34 (KHTML, like Gecko) Version/11.0 Mobile/15A5341f Safari/604.1"},
+  "ipad pro": {1024, 1366, 2, true, true,
+    "Mozilla/5.0 (iPad; CPU OS 11_0 like Mac OS X) AppleWebKit/604.1.34 (KHTML, like Gecko) Version/11.0 Mobile/15A5341f Safari/604.1"},
+}
+
+// 设备和环境模拟（通过Emulation域，在导航之前设置），
+// 设置device时使用预设的视口、缩放、UA等，其它设置会覆盖预设的值
+type Emulation struct {
+  // 预设的设备，如iPhone X、Pixel 5、iPad
+  Device string `yaml:"device"`
+
+  // 视口大小（CSS像素）
+  Width  int `yaml:"width"`
+  Height int `yaml:"height"`
+
+  // 设备像素比，0表示使用默认值
+  DeviceScaleFactor float64 `yaml:"device_scale_factor"`
+
+  // 为nil时使用预设的值（没有device时为false）
+  Mobile *bool `yaml:"mobile"`
+  Touch  *bool `yaml:"touch"`
+
+  // 时区（IANA名称），如Asia/Shanghai
+  Timezone string `yaml:"timezone"`
+
+  // 语言区域（影响Intl和navigator.language），如zh-CN
+  Locale string `yaml:"locale"`
+
+  Geolocation *Geolocation `yaml:"geolocation"`
+
+  // 合并预设后的值
+  metrics   map[string]interface{} `yaml:"-"`
+  touch     bool                   `yaml:"-"`
+  userAgent string                 `yaml:"-"`
+}
+
+type Geolocation struct {
+  Latitude  float64 `yaml:"latitude"`
+  Longitude float64 `yaml:"longitude"`
+
+  // 精度（米），默认为100
+  Accuracy float64 `yaml:"accuracy"`
+}
+
+func (em *Emulation) init() {
+  if em == nil {
+    return
+  }
+  d := devices[strings.ToLower(em.Device)]
+  if d == nil {
+    d = &device{}
+  } else {
+    em.userAgent = d.userAgent
+  }
+  width, height, scale, mobile := d.width, d.height, d.scale, d.mobile
+  em.touch = d.touch
+  if em.Width > 0 && em.Height > 0 {
+    width, height = em.Width, em.Height
+  }
+  if em.DeviceScaleFactor > 0 {
+    scale = em.DeviceScaleFactor
+  }
+  if em.Mobile != nil {
+    mobile = *em.Mobile
+  }
+  if em.Touch != nil {
+    em.touch = *em.Touch
+  }
+  if width > 0 {
+    em.metrics = map[string]interface{}{
+      "width":             width,
+      "height":            height,
+      "deviceScaleFactor": scale,
+      "mobile":            mobile,
+      "screenWidth":       width,
+      "screenHeight":      height,
+    }
+  }
+  if g := em.Geolocation; g != nil && g.Accuracy <= 0 {
+    g.Accuracy = 100
+  }
+}
+
+func (em *Emulation) validate(v *validator, path ...interface{}) {
+  if em == nil {
+    return
+  }
+  if em.Device != "" && devices[strings.ToLower(em.Device)] == nil {
+    v.add(fmt.Sprintf("unknown device %q", em.Device), sub(path, "device")...)
+  }
+  if em.Width < 0 || em.Height < 0 || (em.Width > 0) != (em.Height > 0) {
+    v.add("width and height must be both positive", path...)
+  }
+  // 没有视口大小时不会设置mobile
+  if em.Mobile != nil && *em.Mobile && em.Device == "" && em.Width == 0 {
+    v.add("mobile requires device or width and height", sub(path, "mobile")...)
+  }
+  if em.DeviceScaleFactor < 0 {
+    v.add("device_scale_factor must not be negative", sub(path, "device_scale_factor")...)
+  }
+  if em.Timezone != "" && !timezoneRegexp.MatchString(em.Timezone) {
+    v.add(fmt.Sprintf("invalid timezone %q", em.Timezone), sub(path, "timezone")...)
+  }
+  if em.Locale != "" && !localeRegexp.MatchString(em.Locale) {
+    v.add(fmt.Sprintf("invalid locale %q", em.Locale), sub(path, "locale")...)
+  }
+  em.Geolocation.validate(v, sub(path, "geolocation")...)
+}
+
+func (g *Geolocation) validate(v *validator, path ...interface{}) {
+  if g == nil {
+    return
+  }
+  if g.Latitude < -90 || g.Latitude > 90 {
+    v.add("latitude must be in [-90, 90]", sub(path, "latitude")...)
+  }
+  if g.Longitude < -180 || g.Longitude > 180 {
+    v.add("longitude must be in [-180, 180]", sub(path, "longitude")...)
+  }
+  if g.Accuracy < 0 {
+    v.add("accuracy must not be negative", sub(path, "accuracy")...)
+  }
+}
+
+// 设置模拟（在导航之前调用），UA在applyHeaders中设置，
+// 返回授权geolocation的错误（其它设置不等待结果）
+func (p *Page) emulate(tab cdpTab) error {
+  em := p.Rule.Emulation
+  if em == nil {
+    return nil
+  }
+  if em.metrics != nil {
+    tab.Call(emulationSetDeviceMetricsOverride, em.metrics)
+  }
+  if em.touch {
+    tab.Call(emulationSetTouchEmulationEnabled, map[string]interface{}{"enabled": true, "maxTouchPoints": 5})
+    tab.Call(emulationSetEmitTouchEventsForMouse, map[string]interface{}{"enabled": true, "configuration": "mobile"})
+  }
+  if em.Timezone != "" {
+    tab.Call(emulationSetTimezoneOverride, map[string]interface{}{"timezoneId": em.Timezone})
+  }
+  if em.Locale != "" {
+    tab.Call(emulationSetLocaleOverride, map[string]interface{}{"locale": em.Locale})
+  }
+  g := em.Geolocation
+  if g == nil {
+    return nil
+  }
+  tab.Call(emulationSetGeolocationOverride, map[string]interface{}{
+    "latitude":  g.Latitude,
+    "longitude": g.Longitude,
+    "accuracy":  g.Accuracy,
+  })
+  // 不授权时页面获取位置会被拒绝
+  if e := p.grantPermissions(tab, "geolocation"); e != nil {
+    return fmt.Errorf("grant geolocation permission: %w", e)
+  }
+  return nil
+}
+
+// 为页面的origin授权并等待结果，Browser.grantPermissions是浏览器级别的方法，
+// BrowserContext中的Tab通过浏览器连接调用（只授权该BrowserContext）
+func (p *Page) grantPermissions(tab cdpTab, permissions ...string) error {
+  params := map[string]interface{}{"permissions": permissions}
+  if u, e := url.Parse(p.addr); e == nil && u.Host != "" {
+    params["origin"] = u.Scheme + "://" + u.Host
+  }
+  var ch chan *cdp.Message
+  if t, ok := tab.(*contextTab); ok {
+    params["browserContextId"] = t.contextId
+    _, ch = t.b.call("", browserGrantPermissions, params)
+  } else {
+    _, ch = tab.Call(browserGrantPermissions, params)
+  }
+  if ch == nil {
+    return ErrTabClosed
+  }
+  select {
+  case msg := <-ch:
+    return checkResult(msg)
+  case <-p.ctx.Done():
+    return p.ctx.Err()
+  }
+}
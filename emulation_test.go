@@ -0,0 +1,215 @@
+package collector
+
+import (
+  "context"
+  "errors"
+  "reflect"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+func TestEmulationInit(t *testing.T) {
+  f := false
+  cases := []struct {
+    em    *Emulation
+    want  map[string]interface{}
+    touch bool
+    ua    string
+  }{
+    {&Emulation{Timezone: "UTC"}, nil, false, ""},
+    {&Emulation{Device: "iphone x"},
+      map[string]interface{}{"width": 375, "height": 812, "deviceScaleFactor": 3.0, "mobile": true, "screenWidth": 375, "screenHeight": 812},
+      true, devices["iphone x"].userAgent},
+    {&Emulation{Device: "Pixel 5", Width: 400, Height: 800, Mobile: &f, Touch: &f},
+      map[string]interface{}{"width": 400, "height": 800, "deviceScaleFactor": 2.75, "mobile": false, "screenWidth": 400, "screenHeight": 800},
+      false, devices["pixel 5"].userAgent},
+    {&Emulation{Width: 1920, Height: 1080},
+      map[string]interface{}{"width": 1920, "height": 1080, "deviceScaleFactor": 0.0, "mobile": false, "screenWidth": 1920, "screenHeight": 1080},
+      false, ""},
+  }
+  for i, c := range cases {
+    c.em.init()
+    if !reflect.DeepEqual(c.em.metrics, c.want) || c.em.touch != c.touch || c.em.userAgent != c.ua {
+      t.Errorf("%d: unexpected %v %v %q", i, c.em.metrics, c.em.touch, c.em.userAgent)
+    }
+  }
+}
+
+var emulationRule = `id: "em"
+group: "g"
+patterns: ["example.com"]
+emulation:
+  device: "iPhone X"
+  timezone: "Asia/Shanghai"
+  locale: "zh-CN"
+  geolocation:
+    latitude: 31.23
+    longitude: 121.47
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+`
+
+func TestEmulation(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(emulationRule)); e != nil {
+    t.Fatal(e)
+  }
+  var tab *fakeTab
+  var mu sync.Mutex
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    mu.Lock()
+    defer mu.Unlock()
+    tab = newFakeTab(h, func(string) interface{} { return "ok" })
+    return tab, nil
+  }
+  p := NewPage("http://example.com/1", "g")
+  h := &recordHandler{done: make(chan struct{})}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  // 都在导航之前设置
+  var methods []string
+  for _, msg := range tab.calls {
+    if msg.Method == cdp.Page.Navigate {
+      break
+    }
+    if strings.HasPrefix(msg.Method, "Emulation.") || msg.Method == networkSetUserAgentOverride {
+      methods = append(methods, msg.Method)
+    }
+  }
+  want := []string{
+    networkSetUserAgentOverride,
+    emulationSetDeviceMetricsOverride,
+    emulationSetTouchEmulationEnabled,
+    emulationSetEmitTouchEventsForMouse,
+    emulationSetTimezoneOverride,
+    emulationSetLocaleOverride,
+    emulationSetGeolocationOverride,
+  }
+  if !reflect.DeepEqual(methods, want) {
+    t.Fatalf("want %v, got %v", want, methods)
+  }
+  if ua := tab.Calls(networkSetUserAgentOverride)[0].Params["userAgent"]; ua != devices["iphone x"].userAgent {
+    t.Fatalf("unexpected user agent %v", ua)
+  }
+  geo := tab.Calls(emulationSetGeolocationOverride)[0].Params
+  if geo["latitude"] != 31.23 || geo["longitude"] != 121.47 || geo["accuracy"] != 100.0 {
+    t.Fatalf("unexpected geolocation %v", geo)
+  }
+  grants := tab.Calls(browserGrantPermissions)
+  if len(grants) != 1 || grants[0].Params["origin"] != "http://example.com" {
+    t.Fatalf("geolocation permission not granted to the page origin: %v", grants)
+  }
+}
+
+func TestEmulationGrantFailed(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(emulationRule)); e != nil {
+    t.Fatal(e)
+  }
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    tab := newFakeTab(h, func(string) interface{} { return "ok" })
+    tab.failMethod = browserGrantPermissions
+    return tab, nil
+  }
+  h := &envHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  p := NewPage("http://example.com/1", "g")
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  <-h.done
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  if len(h.errs) != 1 || !errors.Is(h.errs[0], ErrCallFailed) {
+    t.Fatalf("want grant error, got %v", h.errs)
+  }
+  // 不影响采集
+  if p.Err() != nil || h.record["a"] != "ok" {
+    t.Fatalf("unexpected %v %v", p.Err(), h.record)
+  }
+}
+
+func TestEmulationIsolated(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(emulationRule + "isolated: true\n")); e != nil {
+    t.Fatal(e)
+  }
+  b := newFakeBrowser(t, func(string) interface{} { return "ok" })
+  p := NewPage("https://example.com:8443/1", "g")
+  p.newContext = b.newContext()
+  h := &recordHandler{done: make(chan struct{})}
+  if e := p.collect(context.Background(), b.newTab(), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  <-h.done
+  p.Close()
+  b.mu.Lock()
+  defer b.mu.Unlock()
+  // 在浏览器连接上只授权该BrowserContext
+  if len(b.grants) != 1 || b.grants[0]["browserContextId"] != b.created[0] || b.grants[0]["origin"] != "https://example.com:8443" {
+    t.Fatalf("unexpected grants %v", b.grants)
+  }
+}
+
+func TestValidateEmulation(t *testing.T) {
+  data := []byte(`id: "em"
+group: "g"
+patterns: ["example.com"]
+emulation:
+  device: "Nokia 3310"
+  width: 100
+  device_scale_factor: -1
+  timezone: "Asia Shanghai"
+  locale: "chinese"
+  geolocation:
+    latitude: 91
+    longitude: -181
+    accuracy: -1
+fields:
+  - name: "a"
+    eval: "1"
+`)
+  _, e := ParseRule(data)
+  ve, ok := e.(*ValidationError)
+  if !ok {
+    t.Fatalf("want *ValidationError, got %v", e)
+  }
+  if len(ve.Problems) != 8 {
+    t.Fatalf("want 8 problems, got %v", ve)
+  }
+}
+
+func TestValidateEmulationMobile(t *testing.T) {
+  yes := true
+  cases := []struct {
+    em    *Emulation
+    valid bool
+  }{
+    {&Emulation{Mobile: &yes}, false},
+    {&Emulation{Mobile: &yes, Device: "iPad"}, true},
+    {&Emulation{Mobile: &yes, Width: 400, Height: 800}, true},
+  }
+  for i, c := range cases {
+    r := &Rule{Id: "1", Group: "g", Patterns: []string{"x"}, Emulation: c.em, Fields: []*Field{{Name: "a", Eval: "1"}}}
+    e := r.Validate()
+    if c.valid && e != nil {
+      t.Errorf("%d: %v", i, e)
+    }
+    if !c.valid && (e == nil || !strings.Contains(e.Error(), "emulation.mobile: mobile requires device")) {
+      t.Errorf("%d: unexpected %v", i, e)
+    }
+  }
+}
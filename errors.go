@@ -0,0 +1,109 @@
+package collector
+
+import (
+  "errors"
+  "fmt"
+  "strings"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/conv"
+)
+
+var (
+  ErrPrepareFailed = errors.New("prepare eval not true")
+  ErrLoadTimeout   = errors.New("load timeout")
+  ErrCallFailed    = errors.New("cdp call failed")
+)
+
+// 出错的阶段
+type Stage string
+
+const (
+  // 没有开始采集（如没有匹配的规则、创建Tab失败），仅由Crawler回调
+  StageCollect     Stage = "collect"
+  StageNavigate    Stage = "navigate"
+  StageLoad        Stage = "load"
+  StagePrepare     Stage = "prepare"
+  StageField       Stage = "field"
+  StageLoopPrepare Stage = "loop_prepare"
+  StageLoop        Stage = "loop"
+  StageLoopNext    Stage = "loop_next"
+  StageLogin       Stage = "login"
+  StageCapture     Stage = "capture"
+)
+
+// Runtime.evaluate抛出的Javascript异常（exceptionDetails）
+type EvalError struct {
+  Text   string
+  Line   int
+  Column int
+}
+
+func (e *EvalError) Error() string {
+  return fmt.Sprintf("javascript exception at %d:%d: %s", e.Line, e.Column, e.Text)
+}
+
+// Page.navigate返回的错误（errorText，如net::ERR_NAME_NOT_RESOLVED）
+type NavigateError struct {
+  Url  string
+  Text string
+}
+
+func (e *NavigateError) Error() string {
+  return fmt.Sprintf("navigate to %s failed: %s", e.Url, e.Text)
+}
+
+// CDP调用失败的响应中的error（目前只有浏览器连接上的调用会保留），
+// errors.Is(e, ErrCallFailed)为true
+type CallError struct {
+  Method  string
+  Code    int
+  Message string
+  Data    string
+}
+
+func (e *CallError) Error() string {
+  s := fmt.Sprintf("%v: %s: %s (%d)", ErrCallFailed, e.Method, e.Message, e.Code)
+  if e.Data != "" {
+    s += ": " + e.Data
+  }
+  return s
+}
+
+func (e *CallError) Unwrap() error {
+  return ErrCallFailed
+}
+
+// 检查CDP响应，出错的响应没有result字段（有error时返回*CallError），
+// Javascript异常会带有exceptionDetails字段
+func checkResult(msg *cdp.Message) error {
+  if msg.Result == nil {
+    if er := conv.GetMap(msg.Params, "error"); er != nil {
+      return &CallError{
+        Method:  msg.Method,
+        Code:    conv.GetInt(er, "code", 0),
+        Message: conv.GetString(er, "message", ""),
+        Data:    conv.GetString(er, "data", ""),
+      }
+    }
+    return ErrCallFailed
+  }
+  v, ok := msg.Result["exceptionDetails"]
+  if !ok {
+    return nil
+  }
+  details, _ := v.(map[string]interface{})
+  ee := &EvalError{
+    Text:   conv.GetString(details, "text", ""),
+    Line:   conv.GetInt(details, "lineNumber", 0),
+    Column: conv.GetInt(details, "columnNumber", 0),
+  }
+  // exception.description包含异常类型和信息（如TypeError: Cannot read property 'click' of null），
+  // 比text（通常只是Uncaught）更有用，只取第一行（之后是调用栈）
+  if ex := conv.GetMap(details, "exception"); ex != nil {
+    if desc := conv.GetString(ex, "description", ""); desc != "" {
+      ee.Text = strings.SplitN(desc, "\n", 2)[0]
+    }
+  }
+  return ee
+}
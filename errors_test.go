@@ -0,0 +1,45 @@
+package collector
+
+import (
+  "testing"
+
+  "github.com/kwf2030/cdp"
+)
+
+func TestCheckResult(t *testing.T) {
+  msg := &cdp.Message{}
+  if e := checkResult(msg); e != ErrCallFailed {
+    t.Fatalf("want ErrCallFailed, got %v", e)
+  }
+
+  msg.Method = "Target.createBrowserContext"
+  msg.Params = map[string]interface{}{"error": map[string]interface{}{"code": float64(-32602), "message": "Invalid proxy server"}}
+  if e, ok := checkResult(msg).(*CallError); !ok || e.Code != -32602 || e.Error() != "cdp call failed: Target.createBrowserContext: Invalid proxy server (-32602)" {
+    t.Fatalf("want *CallError, got %v", e)
+  }
+  msg.Params = nil
+
+  msg.Result = map[string]interface{}{"result": map[string]interface{}{"type": "string", "value": "ok"}}
+  if e := checkResult(msg); e != nil {
+    t.Fatal(e)
+  }
+
+  msg.Result = map[string]interface{}{
+    "result": map[string]interface{}{"type": "object", "subtype": "error"},
+    "exceptionDetails": map[string]interface{}{
+      "text":         "Uncaught",
+      "lineNumber":   float64(0),
+      "columnNumber": float64(24),
+      "exception": map[string]interface{}{
+        "description": "TypeError: Cannot read property 'click' of null\n    at <anonymous>:1:25",
+      },
+    },
+  }
+  e, ok := checkResult(msg).(*EvalError)
+  if !ok {
+    t.Fatal("want *EvalError")
+  }
+  if e.Text != "TypeError: Cannot read property 'click' of null" || e.Line != 0 || e.Column != 24 {
+    t.Fatalf("unexpected %+v", e)
+  }
+}
@@ -0,0 +1,256 @@
+package collector
+
+import (
+  "context"
+  "encoding/base64"
+  "fmt"
+  "strconv"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+// 不需要浏览器的Tab，eval返回evalFunc的结果
+type fakeTab struct {
+  handler  cdp.Handler
+  evalFunc func(string) interface{}
+  lastId   int32
+  closed   int32
+
+  // 导航后依次发出的请求（requestId为下标），及其响应内容
+  requests []*fakeRequest
+
+  // Network.getAllCookies的结果
+  cookies []interface{}
+
+  // 导航后不发出加载事件（直到超时）
+  noLoad bool
+
+  // Page.navigate返回的errorText（导航失败）
+  errorText string
+
+  // 调用该method返回失败（没有result）
+  failMethod string
+
+  // 每个请求的Network事件按相反的顺序发出（真实的Tab在不同的goroutine中分发事件，顺序不确定）
+  reverse bool
+
+  mu          sync.Mutex
+  expressions []string
+  calls       []*cdp.Message
+}
+
+type fakeRequest struct {
+  method   string
+  url      string
+  mimeType string
+  body     string
+  delay    time.Duration
+}
+
+func newFakeTab(h cdp.Handler, evalFunc func(string) interface{}) *fakeTab {
+  return &fakeTab{handler: h, evalFunc: evalFunc}
+}
+
+func (t *fakeTab) Call(method string, params map[string]interface{}) (int32, chan *cdp.Message) {
+  if atomic.LoadInt32(&t.closed) != 0 {
+    return 0, nil
+  }
+  id := atomic.AddInt32(&t.lastId, 1)
+  msg := &cdp.Message{Id: id, Method: method, Params: params, Result: map[string]interface{}{}}
+  t.mu.Lock()
+  t.calls = append(t.calls, &cdp.Message{Id: id, Method: method, Params: params})
+  t.mu.Unlock()
+  switch method {
+  case cdp.Page.Navigate:
+    msg.Result["frameId"] = "1"
+    msg.Result["loaderId"] = "1"
+    if t.errorText != "" {
+      msg.Result["errorText"] = t.errorText
+    } else if !t.noLoad {
+      t.Fire(cdp.Page.DomContentEventFired, nil)
+      t.Fire(cdp.Page.LoadEventFired, nil)
+    }
+    if len(t.requests) > 0 {
+      go t.sendRequests()
+    }
+  case pageCaptureScreenshot:
+    msg.Result["data"] = base64.StdEncoding.EncodeToString([]byte(params["format"].(string)))
+  case pagePrintToPDF:
+    msg.Result["data"] = base64.StdEncoding.EncodeToString([]byte("%PDF"))
+  case pageCaptureSnapshot:
+    msg.Result["data"] = "MIME-Version: 1.0"
+  case pageGetLayoutMetrics:
+    msg.Result["cssContentSize"] = map[string]interface{}{"x": 0.0, "y": 0.0, "width": 1280.0, "height": 4000.0}
+  case networkGetAllCookies:
+    msg.Result["cookies"] = t.cookies
+  case cdp.Network.GetResponseBody:
+    i, _ := strconv.Atoi(params["requestId"].(string))
+    msg.Result["body"] = t.requests[i].body
+    msg.Result["base64Encoded"] = false
+  case cdp.Runtime.Evaluate:
+    expr := params["expression"].(string)
+    t.mu.Lock()
+    t.expressions = append(t.expressions, expr)
+    t.mu.Unlock()
+    var v interface{}
+    if t.evalFunc != nil {
+      v = t.evalFunc(expr)
+    }
+    // 返回error时模拟Javascript异常
+    if e, ok := v.(error); ok {
+      msg.Result["exceptionDetails"] = map[string]interface{}{"text": e.Error()}
+      break
+    }
+    msg.Result["result"] = map[string]interface{}{"type": "string", "value": v}
+  }
+  if method == t.failMethod {
+    msg.Result = nil
+  }
+  ch := make(chan *cdp.Message, 1)
+  ch <- msg
+  return id, ch
+}
+
+func (t *fakeTab) Fire(event string, params map[string]interface{}) {
+  go t.handler.OnCdpEvent(&cdp.Message{Method: event, Params: params})
+}
+
+func (t *fakeTab) Subscribe(events ...string) {
+}
+
+// 按顺序发出Network事件（Fire不保证顺序），reverse为true时每个请求的事件倒序发出
+func (t *fakeTab) sendRequests() {
+  for i, r := range t.requests {
+    time.Sleep(r.delay)
+    id := strconv.Itoa(i)
+    events := []*cdp.Message{
+      {Method: cdp.Network.RequestWillBeSent, Params: map[string]interface{}{
+        "requestId": id, "request": map[string]interface{}{"method": r.method, "url": r.url},
+      }},
+      {Method: cdp.Network.ResponseReceived, Params: map[string]interface{}{
+        "requestId": id, "response": map[string]interface{}{"url": r.url, "mimeType": r.mimeType},
+      }},
+      {Method: cdp.Network.LoadingFinished, Params: map[string]interface{}{"requestId": id}},
+    }
+    for j := range events {
+      if t.reverse {
+        j = len(events) - 1 - j
+      }
+      t.handler.OnCdpEvent(events[j])
+    }
+  }
+}
+
+func (t *fakeTab) Close() {
+  atomic.StoreInt32(&t.closed, 1)
+}
+
+// 调用过的method的消息
+func (t *fakeTab) Calls(method string) []*cdp.Message {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  var ret []*cdp.Message
+  for _, msg := range t.calls {
+    if msg.Method == method {
+      ret = append(ret, msg)
+    }
+  }
+  return ret
+}
+
+func (t *fakeTab) Expressions() []string {
+  t.mu.Lock()
+  defer t.mu.Unlock()
+  return append([]string(nil), t.expressions...)
+}
+
+func fakeNewTab(evalFunc func(string) interface{}) func(cdp.Handler) (cdpTab, error) {
+  return func(h cdp.Handler) (cdpTab, error) {
+    return newFakeTab(h, evalFunc), nil
+  }
+}
+
+type countHandler struct {
+  wg     *sync.WaitGroup
+  loops  int32
+  fields int32
+}
+
+func (h *countHandler) OnFields(p *Page, data Record) {
+  atomic.AddInt32(&h.fields, 1)
+}
+
+func (h *countHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  atomic.AddInt32(&h.loops, 1)
+  return i < 3
+}
+
+func (h *countHandler) OnComplete(p *Page) {
+  h.wg.Done()
+}
+
+var concurrentRule = `id: "c"
+version: %d
+group: "g"
+patterns: ["example.com"]
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+loop:
+  name: "l"
+  export_cycle: 1
+  eval: "cdp_loop_count"
+  next: "true"
+`
+
+func TestConcurrentPages(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(fmt.Sprintf(concurrentRule, 1))); e != nil {
+    t.Fatal(e)
+  }
+  const n = 100
+  wg := &sync.WaitGroup{}
+  h := &countHandler{wg: wg}
+  stop := make(chan struct{})
+  go func() {
+    // 采集过程中不断替换规则
+    for v := 2; ; v++ {
+      select {
+      case <-stop:
+        return
+      default:
+        rg.AppendBytes([]byte(fmt.Sprintf(concurrentRule, v)))
+      }
+    }
+  }()
+  pages := make([]*Page, n)
+  wg.Add(n)
+  for i := 0; i < n; i++ {
+    pages[i] = NewPage("http://example.com/"+strconv.Itoa(i), "g")
+    go func(p *Page) {
+      e := p.collect(context.Background(), fakeNewTab(func(string) interface{} { return "true" }), rg, h)
+      if e != nil {
+        t.Error(e)
+        wg.Done()
+      }
+    }(pages[i])
+  }
+  wg.Wait()
+  close(stop)
+  if h.fields != n || h.loops != 3*n {
+    t.Fatalf("want %d fields and %d loops, got %d and %d", n, 3*n, h.fields, h.loops)
+  }
+  for _, p := range pages {
+    if p.Rule.Loop.Eval != "cdp_loop_count" || p.Rule.Loop.Next != "true" {
+      t.Fatalf("rule modified: %q %q", p.Rule.Loop.Eval, p.Rule.Loop.Next)
+    }
+    if p.Err() != nil {
+      t.Fatal(p.Err())
+    }
+  }
+}
@@ -3,7 +3,9 @@ module github.com/kwf2030/collector
 go 1.14
 
 require (
+	github.com/gorilla/websocket v1.4.2
 	github.com/kwf2030/cdp v1.1.3
 	github.com/kwf2030/commons v1.2.2
-	gopkg.in/yaml.v2 v2.3.0
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,184 @@
+package collector
+
+import (
+  "fmt"
+  "os"
+  "regexp"
+  "sort"
+  "strings"
+
+  "github.com/kwf2030/cdp"
+)
+
+const (
+  networkSetExtraHTTPHeaders  = "Network.setExtraHTTPHeaders"
+  networkSetCookies           = "Network.setCookies"
+  networkSetUserAgentOverride = "Network.setUserAgentOverride"
+)
+
+var envRegexp = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// 规则引用的环境变量不存在（替换为空字符串）
+type EnvError struct {
+  Name string
+}
+
+func (e *EnvError) Error() string {
+  return fmt.Sprintf("environment variable %s is not set", e.Name)
+}
+
+// 替换${NAME}为环境变量的值（不存在时为空字符串），用于密钥等不适合写在规则中的值
+func expandEnv(s string) string {
+  return envRegexp.ReplaceAllStringFunc(s, func(m string) string {
+    return os.Getenv(m[2 : len(m)-1])
+  })
+}
+
+// 规则的headers、cookies和user_agent引用的不存在的环境变量（去重并排序）
+func missingEnv(r *Rule) []string {
+  values := make([]string, 0, len(r.Headers)+len(r.Cookies)+1)
+  for _, v := range r.Headers {
+    values = append(values, v)
+  }
+  for _, c := range r.Cookies {
+    values = append(values, c.Value)
+  }
+  values = append(values, r.UserAgent)
+  var ret []string
+  seen := make(map[string]bool, 2)
+  for _, v := range values {
+    for _, m := range envRegexp.FindAllStringSubmatch(v, -1) {
+      if _, ok := os.LookupEnv(m[1]); !ok && !seen[m[1]] {
+        seen[m[1]] = true
+        ret = append(ret, m[1])
+      }
+    }
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+type Cookie struct {
+  Name  string `yaml:"name"`
+  Value string `yaml:"value"`
+
+  // 为空时使用页面的URL
+  Domain string `yaml:"domain"`
+  Path   string `yaml:"path"`
+
+  Secure   bool `yaml:"secure"`
+  HttpOnly bool `yaml:"http_only"`
+}
+
+func (c *Cookie) param(addr string) map[string]interface{} {
+  ret := map[string]interface{}{"name": c.Name, "value": expandEnv(c.Value)}
+  if c.Domain != "" {
+    ret["domain"] = c.Domain
+  } else {
+    ret["url"] = addr
+  }
+  switch {
+  case c.Path != "":
+    ret["path"] = c.Path
+  case c.Domain != "":
+    ret["path"] = "/"
+  }
+  if c.Secure {
+    ret["secure"] = true
+  }
+  if c.HttpOnly {
+    ret["httpOnly"] = true
+  }
+  return ret
+}
+
+func (c *Cookie) validate(v *validator, path ...interface{}) {
+  if c.Name == "" {
+    v.add("name is required", sub(path, "name")...)
+  }
+}
+
+// 按名称排序后检查，问题的顺序是确定的
+func validateHeaders(v *validator, headers map[string]string, path ...interface{}) {
+  keys := make([]string, 0, len(headers))
+  for k := range headers {
+    keys = append(keys, k)
+  }
+  sort.Strings(keys)
+  for _, k := range keys {
+    if k == "" || strings.ContainsAny(k, " :\r\n") {
+      v.add(fmt.Sprintf("invalid header %q", k), path...)
+    }
+  }
+}
+
+// 合并规则和Page的请求头（Page的优先，名称不区分大小写）
+func (p *Page) headers() map[string]interface{} {
+  if len(p.Rule.Headers) == 0 && len(p.Headers) == 0 {
+    return nil
+  }
+  ret := make(map[string]interface{}, len(p.Rule.Headers)+len(p.Headers))
+  for k, v := range p.Rule.Headers {
+    ret[k] = expandEnv(v)
+  }
+  for k, v := range p.Headers {
+    for rk := range ret {
+      if strings.EqualFold(rk, k) {
+        delete(ret, rk)
+      }
+    }
+    ret[k] = v
+  }
+  return ret
+}
+
+// 规则的cookies之后是Page的cookies（同名的会覆盖）
+func (p *Page) cookies() []map[string]interface{} {
+  if len(p.Rule.Cookies) == 0 && len(p.Cookies) == 0 {
+    return nil
+  }
+  ret := make([]map[string]interface{}, 0, len(p.Rule.Cookies)+len(p.Cookies))
+  for _, c := range p.Rule.Cookies {
+    ret = append(ret, c.param(p.addr))
+  }
+  for _, c := range p.Cookies {
+    ret = append(ret, c.param(p.addr))
+  }
+  return ret
+}
+
+// Page的UA优先，其次是规则的user_agent，最后是emulation.device预设的UA
+func (p *Page) userAgent() string {
+  if p.UserAgent != "" {
+    return p.UserAgent
+  }
+  if p.Rule.UserAgent == "" && p.Rule.Emulation != nil {
+    return p.Rule.Emulation.userAgent
+  }
+  return expandEnv(p.Rule.UserAgent)
+}
+
+// 环境变量不存在时回调OnError（不中止采集，也不计为失败）
+func (p *Page) checkEnv() {
+  for _, name := range missingEnv(p.Rule) {
+    p.notify(StageNavigate, "", &EnvError{Name: name})
+  }
+}
+
+// 设置请求头、cookies和UA（在导航之前调用）
+func (p *Page) applyHeaders(tab cdpTab) {
+  headers, cookies, ua := p.headers(), p.cookies(), p.userAgent()
+  if headers == nil && cookies == nil && ua == "" {
+    return
+  }
+  tab.Call(cdp.Network.Enable, nil)
+  if headers != nil {
+    tab.Call(networkSetExtraHTTPHeaders, map[string]interface{}{"headers": headers})
+  }
+  if cookies != nil {
+    tab.Call(networkSetCookies, map[string]interface{}{"cookies": cookies})
+  }
+  if ua != "" {
+    tab.Call(networkSetUserAgentOverride, map[string]interface{}{"userAgent": ua})
+  }
+}
@@ -0,0 +1,157 @@
+package collector
+
+import (
+  "context"
+  "os"
+  "reflect"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+func TestExpandEnv(t *testing.T) {
+  os.Setenv("COLLECTOR_TEST_SID", "s3cret")
+  defer os.Unsetenv("COLLECTOR_TEST_SID")
+  cases := map[string]string{
+    "${COLLECTOR_TEST_SID}":         "s3cret",
+    "sid=${COLLECTOR_TEST_SID};":    "sid=s3cret;",
+    "${COLLECTOR_TEST_NOPE}":        "",
+    "$COLLECTOR_TEST_SID":           "$COLLECTOR_TEST_SID",
+    "${COLLECTOR_TEST_SID":          "${COLLECTOR_TEST_SID",
+    "price: $5, ${COLLECTOR_TEST_}": "price: $5, ",
+  }
+  for in, want := range cases {
+    if got := expandEnv(in); got != want {
+      t.Errorf("%q: want %q, got %q", in, want, got)
+    }
+  }
+}
+
+var headersRule = `id: "h"
+group: "g"
+patterns: ["example.com"]
+headers:
+  Accept-Language: "zh-CN"
+  Authorization: "Bearer ${COLLECTOR_TEST_TOKEN}"
+cookies:
+  - name: "sid"
+    value: "${COLLECTOR_TEST_TOKEN}"
+  - name: "area"
+    value: "1"
+    domain: ".example.com"
+user_agent: "rule-agent"
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+`
+
+func TestHeaders(t *testing.T) {
+  os.Setenv("COLLECTOR_TEST_TOKEN", "t0ken")
+  defer os.Unsetenv("COLLECTOR_TEST_TOKEN")
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(headersRule)); e != nil {
+    t.Fatal(e)
+  }
+  var tab *fakeTab
+  var mu sync.Mutex
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    mu.Lock()
+    defer mu.Unlock()
+    tab = newFakeTab(h, func(string) interface{} { return "ok" })
+    return tab, nil
+  }
+  p := NewPage("http://example.com/1", "g")
+  p.Headers = map[string]string{"Accept-Language": "en-US", "Referer": "http://example.com"}
+  p.Cookies = []*Cookie{{Name: "job", Value: "7", Path: "/x"}}
+  p.UserAgent = "page-agent"
+  h := &recordHandler{done: make(chan struct{})}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  headers := tab.Calls(networkSetExtraHTTPHeaders)[0].Params["headers"]
+  wantHeaders := map[string]interface{}{"Accept-Language": "en-US", "Authorization": "Bearer t0ken", "Referer": "http://example.com"}
+  if !reflect.DeepEqual(headers, wantHeaders) {
+    t.Fatalf("want headers %v, got %v", wantHeaders, headers)
+  }
+  cookies := tab.Calls(networkSetCookies)[0].Params["cookies"]
+  wantCookies := []map[string]interface{}{
+    {"name": "sid", "value": "t0ken", "url": "http://example.com/1"},
+    {"name": "area", "value": "1", "domain": ".example.com", "path": "/"},
+    {"name": "job", "value": "7", "url": "http://example.com/1", "path": "/x"},
+  }
+  if !reflect.DeepEqual(cookies, wantCookies) {
+    t.Fatalf("want cookies %v, got %v", wantCookies, cookies)
+  }
+  if ua := tab.Calls(networkSetUserAgentOverride)[0].Params["userAgent"]; ua != "page-agent" {
+    t.Fatalf("want page-agent, got %v", ua)
+  }
+  // 必须在导航之前设置
+  tab.mu.Lock()
+  defer tab.mu.Unlock()
+  for _, msg := range tab.calls {
+    if msg.Method == cdp.Page.Navigate {
+      t.Fatal("navigated before setting headers")
+    }
+    if msg.Method == networkSetUserAgentOverride {
+      break
+    }
+  }
+}
+
+func TestHeadersOverride(t *testing.T) {
+  p := NewPage("http://example.com", "g")
+  p.Rule = &Rule{Headers: map[string]string{"accept-language": "zh-CN", "X-Token": "1"}}
+  p.Headers = map[string]string{"Accept-Language": "en-US"}
+  want := map[string]interface{}{"Accept-Language": "en-US", "X-Token": "1"}
+  if headers := p.headers(); !reflect.DeepEqual(headers, want) {
+    t.Fatalf("want %v, got %v", want, headers)
+  }
+}
+
+type envHandler struct {
+  recordHandler
+  mu   sync.Mutex
+  errs []error
+}
+
+func (h *envHandler) OnError(p *Page, stage Stage, name string, e error) {
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  h.errs = append(h.errs, e)
+}
+
+func TestMissingEnv(t *testing.T) {
+  os.Unsetenv("COLLECTOR_TEST_TOKEN")
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(headersRule)); e != nil {
+    t.Fatal(e)
+  }
+  h := &envHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  p := NewPage("http://example.com/1", "g")
+  if e := p.collect(context.Background(), fakeNewTab(func(string) interface{} { return "ok" }), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  <-h.done
+  h.mu.Lock()
+  defer h.mu.Unlock()
+  // headers和cookies都引用了，只回调一次
+  if len(h.errs) != 1 {
+    t.Fatalf("want 1 error, got %v", h.errs)
+  }
+  if ee, ok := h.errs[0].(*EnvError); !ok || ee.Name != "COLLECTOR_TEST_TOKEN" {
+    t.Fatalf("want *EnvError, got %v", h.errs[0])
+  }
+  if p.Err() != nil || h.record["a"] != "ok" {
+    t.Fatalf("collection should go on, got %v %v", p.Err(), h.record)
+  }
+}
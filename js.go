@@ -0,0 +1,54 @@
+package collector
+
+import (
+  "encoding/json"
+  "strconv"
+  "strings"
+)
+
+// U+2028/U+2029在JSON字符串中是合法的，但在ES2019之前的Javascript字符串中是换行符
+var lineSeparators = strings.NewReplacer("\u2028", `\u2028`, "\u2029", `\u2029`)
+
+// 把字符串编码为Javascript字符串字面量，
+// JSON字符串是合法的Javascript字符串，引号、反斜杠、换行等都会被转义，
+// json.Marshal还会转义<、>和&，所以也可以安全地嵌入</script>等内容
+func jsString(s string) string {
+  return jsLiteral(s)
+}
+
+// 把值编码为Javascript字面量，值必须能被JSON编码（Field.Type对应的类型都可以），
+// 无法编码时返回null，U+2028/U+2029总是被转义（不依赖json.Marshal的实现）
+func jsLiteral(v interface{}) string {
+  b, e := json.Marshal(v)
+  if e != nil {
+    return "null"
+  }
+  return lineSeparators.Replace(string(b))
+}
+
+// 把field的值声明为全局变量（cdp_field_<name>）
+func fieldVarExpr(name string, value interface{}) string {
+  return "const cdp_field_" + name + "=" + jsLiteral(value) + ";"
+}
+
+// field同时有eval和value时，value作为eval的局部变量（cdp_field_value）
+func fieldValueExpr(value, eval string) string {
+  return "{let cdp_field_value=" + jsString(value) + ";" + eval + "}"
+}
+
+// 包装为块语句（let/const不会污染全局），已经是块语句的不处理
+func blockExpr(s string) string {
+  if s == "" || s[0] == '{' {
+    return s
+  }
+  return "{" + s + "}"
+}
+
+// 声明循环次数全局变量（在loop的prepare之前）
+func loopCountDeclExpr(i int) string {
+  return "let cdp_loop_count=" + strconv.Itoa(i) + ";"
+}
+
+func loopCountExpr(i int) string {
+  return "cdp_loop_count=" + strconv.Itoa(i) + ";"
+}
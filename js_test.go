@@ -0,0 +1,133 @@
+package collector
+
+import (
+  "encoding/json"
+  "io/ioutil"
+  "os"
+  "os/exec"
+  "strings"
+  "testing"
+)
+
+var hostileValues = []string{
+  "",
+  "plain",
+  "it's",
+  `say "hi"`,
+  `back\slash`,
+  `\'`,
+  "line1\nline2\r\nline3",
+  "tab\there",
+  "</script><script>alert(1)</script>",
+  "';alert(document.cookie);'",
+  "`${alert(1)}`",
+  "中文，全角标点：１２３",
+  "emoji 😀 and \u2028 line\u2029separators",
+  "\u2028",
+  "\u2029",
+  "{\"a\":\"\u2028\"}\u2029",
+  "nul\x00byte",
+  "1,234.00",
+}
+
+func TestFieldVarExpr(t *testing.T) {
+  const prefix = "const cdp_field_name="
+  for _, v := range hostileValues {
+    expr := fieldVarExpr("name", v)
+    if !strings.HasPrefix(expr, prefix) || !strings.HasSuffix(expr, ";") {
+      t.Fatalf("malformed expression %q", expr)
+    }
+    lit := expr[len(prefix) : len(expr)-1]
+    assertLiteral(t, lit, v)
+  }
+}
+
+func TestFieldValueExpr(t *testing.T) {
+  const prefix = "{let cdp_field_value="
+  const eval = "cdp_field_value.length"
+  for _, v := range hostileValues {
+    expr := fieldValueExpr(v, eval)
+    if !strings.HasPrefix(expr, prefix) || !strings.HasSuffix(expr, ";"+eval+"}") {
+      t.Fatalf("malformed expression %q", expr)
+    }
+    lit := expr[len(prefix) : len(expr)-len(eval)-2]
+    assertLiteral(t, lit, v)
+  }
+}
+
+func TestLoopCountExpr(t *testing.T) {
+  if s := loopCountDeclExpr(1); s != "let cdp_loop_count=1;" {
+    t.Fatal(s)
+  }
+  if s := loopCountExpr(12); s != "cdp_loop_count=12;" {
+    t.Fatal(s)
+  }
+}
+
+func TestJsStringLineSeparators(t *testing.T) {
+  if s := jsString("a\u2028b\u2029c"); s != `"a\u2028b\u2029c"` {
+    t.Fatalf("line separators not escaped: %q", s)
+  }
+  if s := jsLiteral([]interface{}{"\u2028"}); s != `["\u2028"]` {
+    t.Fatalf("line separators not escaped: %q", s)
+  }
+}
+
+// 在Javascript中执行生成的表达式，检查得到的值与原值相同（需要node，没有则跳过）
+func TestEvalLiterals(t *testing.T) {
+  node, e := exec.LookPath("node")
+  if e != nil {
+    t.Skip("node not found")
+  }
+  var sb strings.Builder
+  sb.WriteString("const out=[];\n")
+  for _, v := range hostileValues {
+    sb.WriteString("{" + fieldVarExpr("name", v) + "out.push(cdp_field_name);}\n")
+    sb.WriteString(fieldValueExpr(v, "out.push(cdp_field_value)") + "\n")
+  }
+  sb.WriteString("console.log(JSON.stringify(out));\n")
+  f, e := ioutil.TempFile("", "literals*.js")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.Remove(f.Name())
+  f.WriteString(sb.String())
+  f.Close()
+  output, e := exec.Command(node, f.Name()).CombinedOutput()
+  if e != nil {
+    t.Fatalf("%v: %s", e, output)
+  }
+  var got []string
+  if e := json.Unmarshal(output, &got); e != nil {
+    t.Fatalf("%v: %s", e, output)
+  }
+  if len(got) != 2*len(hostileValues) {
+    t.Fatalf("want %d values, got %d", 2*len(hostileValues), len(got))
+  }
+  for i, v := range hostileValues {
+    if got[2*i] != v || got[2*i+1] != v {
+      t.Errorf("want %q, got %q and %q", v, got[2*i], got[2*i+1])
+    }
+  }
+}
+
+// 字面量必须是单行、不含</script>，且解码后与原值完全相同
+func assertLiteral(t *testing.T, lit, want string) {
+  t.Helper()
+  if strings.ContainsAny(lit, "\n\r\u2028\u2029") {
+    t.Fatalf("literal %q contains line terminator", lit)
+  }
+  if strings.Contains(lit, "</") {
+    t.Fatalf("literal %q contains </", lit)
+  }
+  if lit[0] != '"' || lit[len(lit)-1] != '"' {
+    t.Fatalf("literal %q not quoted", lit)
+  }
+  var got string
+  if e := json.Unmarshal([]byte(lit), &got); e != nil {
+    t.Fatal(e)
+  }
+  if got != want {
+    t.Fatalf("round-trip mismatch: want %q, got %q", want, got)
+  }
+}
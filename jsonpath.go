@@ -0,0 +1,138 @@
+package collector
+
+import (
+  "errors"
+  "fmt"
+  "sort"
+  "strconv"
+  "strings"
+)
+
+var ErrPathNotFound = errors.New("json path not found")
+
+// JSONPath的子集：$、.name、['name']/["name"]、[n]（n可以是负数）、[*]和.*，
+// 有通配符时返回数组（不存在的元素会被忽略），否则返回单个值
+type jsonPath struct {
+  src   string
+  steps []pathStep
+  multi bool
+}
+
+type pathStep struct {
+  key   string
+  index int
+  // 0：key，1：index，2：通配符
+  kind int
+}
+
+const (
+  stepKey = iota
+  stepIndex
+  stepAll
+)
+
+func compileJSONPath(s string) (*jsonPath, error) {
+  if s == "" || s[0] != '$' {
+    return nil, fmt.Errorf("json path %q must start with $", s)
+  }
+  p := &jsonPath{src: s}
+  i := 1
+  for i < len(s) {
+    switch s[i] {
+    case '.':
+      i++
+      if i < len(s) && s[i] == '*' {
+        p.steps = append(p.steps, pathStep{kind: stepAll})
+        p.multi = true
+        i++
+        continue
+      }
+      j := i
+      for j < len(s) && s[j] != '.' && s[j] != '[' {
+        j++
+      }
+      if j == i {
+        return nil, fmt.Errorf("json path %q: empty name at %d", s, i)
+      }
+      p.steps = append(p.steps, pathStep{key: s[i:j]})
+      i = j
+    case '[':
+      j := strings.IndexByte(s[i:], ']')
+      if j == -1 {
+        return nil, fmt.Errorf("json path %q: missing ]", s)
+      }
+      in := s[i+1 : i+j]
+      switch {
+      case in == "*":
+        p.steps = append(p.steps, pathStep{kind: stepAll})
+        p.multi = true
+      case len(in) >= 2 && (in[0] == '\'' || in[0] == '"') && in[len(in)-1] == in[0]:
+        p.steps = append(p.steps, pathStep{key: in[1 : len(in)-1]})
+      default:
+        n, e := strconv.Atoi(in)
+        if e != nil {
+          return nil, fmt.Errorf("json path %q: invalid index %q", s, in)
+        }
+        p.steps = append(p.steps, pathStep{index: n, kind: stepIndex})
+      }
+      i += j + 1
+    default:
+      return nil, fmt.Errorf("json path %q: unexpected %q at %d", s, s[i], i)
+    }
+  }
+  return p, nil
+}
+
+func (p *jsonPath) eval(v interface{}) (interface{}, error) {
+  values := []interface{}{v}
+  for _, st := range p.steps {
+    next := make([]interface{}, 0, len(values))
+    for _, v := range values {
+      switch st.kind {
+      case stepKey:
+        if m, ok := v.(map[string]interface{}); ok {
+          if x, ok := m[st.key]; ok {
+            next = append(next, x)
+          }
+        }
+      case stepIndex:
+        if a, ok := v.([]interface{}); ok {
+          i := st.index
+          if i < 0 {
+            i += len(a)
+          }
+          if i >= 0 && i < len(a) {
+            next = append(next, a[i])
+          }
+        }
+      case stepAll:
+        switch x := v.(type) {
+        case []interface{}:
+          next = append(next, x...)
+        case map[string]interface{}:
+          for _, k := range sortedKeys(x) {
+            next = append(next, x[k])
+          }
+        }
+      }
+    }
+    values = next
+  }
+  if p.multi {
+    return values, nil
+  }
+  if len(values) == 0 {
+    return nil, fmt.Errorf("%w: %s", ErrPathNotFound, p.src)
+  }
+  return values[0], nil
+}
+
+// 按key排序，保证.*的结果顺序固定
+func sortedKeys(m map[string]interface{}) []string {
+  ret := make([]string, 0, len(m))
+  for k := range m {
+    ret = append(ret, k)
+  }
+  sort.Strings(ret)
+  return ret
+}
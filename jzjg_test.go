@@ -1,7 +1,6 @@
 package collector
 
 import (
-  "encoding/json"
   "fmt"
   "runtime"
   "sync"
@@ -28,7 +27,8 @@ loop:
   name: "url"
   alias: "链接"
   export_cycle: 1
-  eval: "{let ret=[];let arr=Array.prototype.slice.call(document.querySelectorAll('.primary'));for (let i=0;i<arr.length;i++) {ret[i]=arr[i].firstElementChild.href;}JSON.stringify(ret);}"
+  type: "array"
+  eval: "{let ret=[];let arr=Array.prototype.slice.call(document.querySelectorAll('.primary'));for (let i=0;i<arr.length;i++) {ret[i]=arr[i].firstElementChild.href;}ret;}"
   next: "{Array.prototype.slice.call(document.querySelector('.quotes').children).filter(e => {return e.textContent.trim()==(cdp_loop_count+1).toString()})[0].click();true}"
   wait: "5s"
 `)
@@ -120,20 +120,16 @@ func TestJZJG(t *testing.T) {
 
 type OrgList struct{}
 
-func (s *OrgList) OnFields(p *Page, data map[string]string) {
+func (s *OrgList) OnFields(p *Page, data Record) {
 }
 
-func (s *OrgList) OnLoop(p *Page, loopCount int, data []string) bool {
-  var arr []string
-  e := json.Unmarshal([]byte(data[0]), &arr)
-  if e != nil {
-    panic(e)
-  }
+func (s *OrgList) OnLoop(p *Page, loopCount int, data []interface{}) bool {
+  arr, _ := data[0].([]interface{})
   fmt.Printf("====================第%d页（%d家企业）\n", loopCount, len(arr))
   for _, v := range arr {
     w := &sync.WaitGroup{}
     w.Add(1)
-    crawlOrg(w, v)
+    crawlOrg(w, v.(string))
     w.Wait()
     time.Sleep(time.Millisecond * 500)
   }
@@ -148,13 +144,13 @@ type OrgDetail struct {
   w *sync.WaitGroup
 }
 
-func (s *OrgDetail) OnFields(p *Page, data map[string]string) {
+func (s *OrgDetail) OnFields(p *Page, data Record) {
   for _, f := range p.Rule.Fields {
     fmt.Println(f.Alias, ":", data[f.Name])
   }
 }
 
-func (s *OrgDetail) OnLoop(p *Page, loopCount int, data []string) bool {
+func (s *OrgDetail) OnLoop(p *Page, loopCount int, data []interface{}) bool {
   return true
 }
 
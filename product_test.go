@@ -46,12 +46,12 @@ loop:
 
 type Product struct{}
 
-func (*Product) OnFields(p *Page, data map[string]string) {
+func (*Product) OnFields(p *Page, data Record) {
   fmt.Println("==========OnFields:")
   fmt.Println(data)
 }
 
-func (*Product) OnLoop(p *Page, loopCount int, data []string) bool {
+func (*Product) OnLoop(p *Page, loopCount int, data []interface{}) bool {
   fmt.Println("==========OnLoop:", loopCount)
   fmt.Println(data)
   return true
@@ -0,0 +1,308 @@
+package collector
+
+import (
+  "errors"
+  "fmt"
+  "net"
+  "net/url"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/base"
+)
+
+// Rule.Proxy为该值时不使用代理（即使分组设置了ProxyPool）
+const ProxyDirect = "direct"
+
+// 使用代理时，OnFields的Record中该字段为使用的代理（@不会与字段名冲突）
+const RecordProxy = "@proxy"
+
+const (
+  // Host在该时间内没有再使用时，下次重新分配代理
+  defaultHostTTL = time.Minute * 30
+
+  // 最多记录的Host数，超过时移除最久没有使用的
+  defaultMaxHosts = 10000
+)
+
+var (
+  ErrNoProxy      = errors.New("no healthy proxy")
+  ErrInvalidProxy = errors.New("invalid proxy")
+)
+
+var proxySchemes = map[string]bool{"http": true, "https": true, "socks4": true, "socks5": true}
+
+// 解析代理（如http://127.0.0.1:8080、socks5://127.0.0.1:1080），返回host:port，
+// Chrome的proxyServer不支持用户名和密码
+func parseProxy(s string) (string, error) {
+  u, e := url.Parse(s)
+  if e != nil || !proxySchemes[strings.ToLower(u.Scheme)] || u.User != nil || u.Port() == "" ||
+    u.Hostname() == "" || strings.Trim(u.Path, "/") != "" {
+    return "", ErrInvalidProxy
+  }
+  return u.Host, nil
+}
+
+func validateProxy(v *validator, proxy string, path ...interface{}) {
+  if proxy == "" || proxy == ProxyDirect {
+    return
+  }
+  if _, e := parseProxy(proxy); e != nil {
+    v.add(fmt.Sprintf("invalid proxy %q (want direct or scheme://host:port, scheme is http, https, socks4 or socks5)", proxy), path...)
+  }
+}
+
+type proxy struct {
+  server string
+  addr   string
+
+  // 连续失败次数
+  failures int
+  evicted  bool
+}
+
+// Host分配的代理
+type stickyHost struct {
+  p    *proxy
+  used time.Time
+}
+
+// 代理池，按Host分配代理（同一个Host一直使用同一个代理，直到该代理失败），
+// 新的Host按顺序轮流分配，
+// 连续导航失败maxFailures次的代理会被移出，由健康检查（能连接上）恢复
+type ProxyPool struct {
+  proxies     []*proxy
+  maxFailures int
+
+  // 下一个分配的代理
+  next int
+
+  // Host-->代理，超过hostTTL没有使用或超过maxHosts时移除
+  hosts    map[string]*stickyHost
+  hostTTL  time.Duration
+  maxHosts int
+
+  stopChan chan struct{}
+  once     sync.Once
+  mu       sync.Mutex
+}
+
+// maxFailures小于等于0时为3
+func NewProxyPool(servers []string, maxFailures int) (*ProxyPool, error) {
+  if len(servers) == 0 {
+    return nil, base.ErrInvalidArgument
+  }
+  if maxFailures <= 0 {
+    maxFailures = 3
+  }
+  pp := &ProxyPool{
+    proxies:     make([]*proxy, 0, len(servers)),
+    maxFailures: maxFailures,
+    hosts:       make(map[string]*stickyHost, 16),
+    hostTTL:     defaultHostTTL,
+    maxHosts:    defaultMaxHosts,
+    stopChan:    make(chan struct{}),
+  }
+  for _, s := range servers {
+    addr, e := parseProxy(s)
+    if e != nil {
+      return nil, e
+    }
+    pp.proxies = append(pp.proxies, &proxy{server: s, addr: addr})
+  }
+  return pp, nil
+}
+
+// 可用（未被移出）的代理
+func (pp *ProxyPool) Healthy() []string {
+  pp.mu.Lock()
+  defer pp.mu.Unlock()
+  ret := make([]string, 0, len(pp.proxies))
+  for _, p := range pp.proxies {
+    if !p.evicted {
+      ret = append(ret, p.server)
+    }
+  }
+  return ret
+}
+
+// 为Host分配代理，没有可用的代理时返回ErrNoProxy
+func (pp *ProxyPool) get(host string) (string, error) {
+  pp.mu.Lock()
+  defer pp.mu.Unlock()
+  now := time.Now()
+  if h, ok := pp.hosts[host]; ok && !h.p.evicted && now.Sub(h.used) < pp.hostTTL {
+    h.used = now
+    return h.p.server, nil
+  }
+  delete(pp.hosts, host)
+  for i := 0; i < len(pp.proxies); i++ {
+    p := pp.proxies[pp.next]
+    pp.next = (pp.next + 1) % len(pp.proxies)
+    if !p.evicted {
+      pp.shrink(now)
+      pp.hosts[host] = &stickyHost{p: p, used: now}
+      return p.server, nil
+    }
+  }
+  return "", ErrNoProxy
+}
+
+// 达到maxHosts时先移除过期的Host，仍然达到时移除最久没有使用的
+func (pp *ProxyPool) shrink(now time.Time) {
+  if len(pp.hosts) < pp.maxHosts {
+    return
+  }
+  var oldest string
+  for host, h := range pp.hosts {
+    if now.Sub(h.used) >= pp.hostTTL {
+      delete(pp.hosts, host)
+    } else if oldest == "" || h.used.Before(pp.hosts[oldest].used) {
+      oldest = host
+    }
+  }
+  if len(pp.hosts) >= pp.maxHosts {
+    delete(pp.hosts, oldest)
+  }
+}
+
+// 导航成功
+func (pp *ProxyPool) succeed(server string) {
+  pp.mu.Lock()
+  defer pp.mu.Unlock()
+  if p := pp.find(server); p != nil {
+    p.failures = 0
+  }
+}
+
+// 导航失败，使用该代理的Host下次会重新分配
+func (pp *ProxyPool) fail(server string) {
+  pp.mu.Lock()
+  defer pp.mu.Unlock()
+  p := pp.find(server)
+  if p == nil {
+    return
+  }
+  p.failures++
+  if p.failures >= pp.maxFailures {
+    p.evicted = true
+  }
+  for host, h := range pp.hosts {
+    if h.p == p {
+      delete(pp.hosts, host)
+    }
+  }
+}
+
+func (pp *ProxyPool) find(server string) *proxy {
+  for _, p := range pp.proxies {
+    if p.server == server {
+      return p
+    }
+  }
+  return nil
+}
+
+// 检查一次所有代理（能否在timeout内建立TCP连接），
+// 不能连接的被移出，能连接的恢复（失败次数清零）
+func (pp *ProxyPool) Check(timeout time.Duration) {
+  pp.mu.Lock()
+  proxies := append([]*proxy(nil), pp.proxies...)
+  pp.mu.Unlock()
+  ok := make([]bool, len(proxies))
+  wg := &sync.WaitGroup{}
+  wg.Add(len(proxies))
+  for i, p := range proxies {
+    go func(i int, addr string) {
+      defer wg.Done()
+      if conn, e := net.DialTimeout("tcp", addr, timeout); e == nil {
+        conn.Close()
+        ok[i] = true
+      }
+    }(i, p.addr)
+  }
+  wg.Wait()
+  pp.mu.Lock()
+  defer pp.mu.Unlock()
+  for i, p := range proxies {
+    if ok[i] {
+      p.failures = 0
+      p.evicted = false
+    } else {
+      p.evicted = true
+    }
+  }
+}
+
+// 每隔interval检查一次（在新的goroutine中），直到调用Stop
+func (pp *ProxyPool) StartHealthCheck(interval, timeout time.Duration) {
+  if interval <= 0 {
+    return
+  }
+  go func() {
+    ticker := time.NewTicker(interval)
+    defer ticker.Stop()
+    for {
+      select {
+      case <-pp.stopChan:
+        return
+      case <-ticker.C:
+        pp.Check(timeout)
+      }
+    }
+  }()
+}
+
+func (pp *ProxyPool) Stop() {
+  pp.once.Do(func() {
+    close(pp.stopChan)
+  })
+}
+
+// 当前尝试使用的代理，按Page、规则、分组的顺序，
+// 返回代理（为空表示不使用）和分配该代理的ProxyPool（规则指定的代理为nil）
+func (p *Page) proxy() (string, *ProxyPool, error) {
+  pool := p.ProxyPool
+  if pool == nil {
+    switch p.Rule.Proxy {
+    case ProxyDirect:
+      return "", nil, nil
+    case "":
+      if p.rg != nil {
+        pool = p.rg.ProxyPool()
+      }
+    default:
+      return p.Rule.Proxy, nil, nil
+    }
+  }
+  if pool == nil {
+    return "", nil, nil
+  }
+  server, e := pool.get(hostOf(p.addr))
+  return server, pool, e
+}
+
+// 页面加载的结果，导航出错（如ERR_PROXY_CONNECTION_FAILED）、Tab被关闭或加载超时计为代理失败，
+// 每次尝试只记录第一次的结果
+func (a *attempt) proxyResult(e error) {
+  if a.pool == nil {
+    return
+  }
+  a.proxyOnce.Do(func() {
+    if e == nil {
+      a.pool.succeed(a.proxy)
+    } else {
+      a.pool.fail(a.proxy)
+    }
+  })
+}
+
+// 当前（或最后一次）尝试使用的代理，为空表示没有使用代理，
+// 可以在Handler中调用，用于记录结果的来源
+func (p *Page) Proxy() string {
+  if a := p.current(); a != nil {
+    return a.proxy
+  }
+  return ""
+}
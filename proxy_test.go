@@ -0,0 +1,259 @@
+package collector
+
+import (
+  "context"
+  "fmt"
+  "net"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+func TestParseProxy(t *testing.T) {
+  cases := map[string]string{
+    "http://127.0.0.1:8080":   "127.0.0.1:8080",
+    "socks5://proxy.lan:1080": "proxy.lan:1080",
+    "SOCKS4://[::1]:1080/":    "[::1]:1080",
+    "ftp://127.0.0.1:21":      "",
+    "http://127.0.0.1":        "",
+    "http://u:p@127.0.0.1:80": "",
+    "127.0.0.1:8080":          "",
+    "http://127.0.0.1:80/x":   "",
+  }
+  for in, want := range cases {
+    got, e := parseProxy(in)
+    if (e != nil) != (want == "") || got != want {
+      t.Errorf("%q: want %q, got %q(%v)", in, want, got, e)
+    }
+  }
+}
+
+func TestProxyPool(t *testing.T) {
+  if _, e := NewProxyPool([]string{"http://a:1", "nope"}, 0); e != ErrInvalidProxy {
+    t.Fatalf("want ErrInvalidProxy, got %v", e)
+  }
+  pp, _ := NewProxyPool([]string{"http://a:1", "http://b:1", "http://c:1"}, 2)
+  // 新的Host轮流分配，同一个Host使用同一个代理
+  for i, want := range []string{"http://a:1", "http://b:1", "http://a:1", "http://c:1"} {
+    host := []string{"x", "y", "x", "z"}[i]
+    if got, _ := pp.get(host); got != want {
+      t.Fatalf("%s: want %s, got %s", host, want, got)
+    }
+  }
+  // 失败后重新分配，连续失败2次被移出
+  pp.fail("http://a:1")
+  if got, _ := pp.get("x"); got != "http://a:1" {
+    t.Fatalf("want http://a:1 (round robin), got %s", got)
+  }
+  pp.fail("http://a:1")
+  if got, _ := pp.get("x"); got != "http://b:1" {
+    t.Fatalf("want http://b:1, got %s", got)
+  }
+  if got := pp.Healthy(); !reflect.DeepEqual(got, []string{"http://b:1", "http://c:1"}) {
+    t.Fatalf("unexpected healthy %v", got)
+  }
+  // 成功后失败次数清零
+  pp.fail("http://b:1")
+  pp.succeed("http://b:1")
+  pp.fail("http://b:1")
+  pp.fail("http://c:1")
+  pp.fail("http://c:1")
+  if got := pp.Healthy(); !reflect.DeepEqual(got, []string{"http://b:1"}) {
+    t.Fatalf("unexpected healthy %v", got)
+  }
+  pp.fail("http://b:1")
+  if _, e := pp.get("x"); e != ErrNoProxy {
+    t.Fatalf("want ErrNoProxy, got %v", e)
+  }
+}
+
+func TestProxyPoolCheck(t *testing.T) {
+  l, e := net.Listen("tcp", "127.0.0.1:0")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer l.Close()
+  go func() {
+    for {
+      conn, e := l.Accept()
+      if e != nil {
+        return
+      }
+      conn.Close()
+    }
+  }()
+  // 关闭的端口
+  l2, _ := net.Listen("tcp", "127.0.0.1:0")
+  closed := l2.Addr().String()
+  l2.Close()
+  up, down := "http://"+l.Addr().String(), "socks5://"+closed
+  pp, _ := NewProxyPool([]string{up, down}, 1)
+  pp.fail(up)
+  pp.Check(time.Second)
+  if got := pp.Healthy(); !reflect.DeepEqual(got, []string{up}) {
+    t.Fatalf("want [%s], got %v", up, got)
+  }
+  pp.fail(up)
+  pp.StartHealthCheck(time.Millisecond*10, time.Second)
+  defer pp.Stop()
+  deadline := time.Now().Add(time.Second * 5)
+  for len(pp.Healthy()) == 0 {
+    if time.Now().After(deadline) {
+      t.Fatal("not restored by health check")
+    }
+    time.Sleep(time.Millisecond * 10)
+  }
+}
+
+var proxyRule = `id: "p"
+group: "g"
+patterns: ["example.com"]
+proxy: "%s"
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+`
+
+func collectProxy(t *testing.T, rule string, pool, groupPool *ProxyPool, addr string) (*Page, *fakeBrowser, *recordHandler) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(fmt.Sprintf(proxyRule, rule))); e != nil {
+    t.Fatal(e)
+  }
+  rg.SetProxyPool(groupPool)
+  b := newFakeBrowser(t, func(string) interface{} { return "title" })
+  p := NewPage(addr, "g")
+  p.ProxyPool = pool
+  p.newContext = b.newContext()
+  h := &recordHandler{done: make(chan struct{})}
+  if e := p.collect(context.Background(), b.newTab(), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if p.Err() != nil {
+    t.Fatal(p.Err())
+  }
+  p.Close()
+  return p, b, h
+}
+
+func TestProxyCollect(t *testing.T) {
+  pagePool, _ := NewProxyPool([]string{"http://page:1"}, 0)
+  groupPool, _ := NewProxyPool([]string{"http://group1:1", "http://group2:1"}, 0)
+  cases := []struct {
+    rule       string
+    pool, gp   *ProxyPool
+    addr, want string
+  }{
+    {"", nil, nil, "http://example.com/1", ""},
+    {"direct", nil, groupPool, "http://example.com/1", ""},
+    {"socks5://rule:1", nil, groupPool, "http://example.com/1", "socks5://rule:1"},
+    {"direct", pagePool, groupPool, "http://example.com/1", "http://page:1"},
+    {"", nil, groupPool, "http://example.com/1", "http://group1:1"},
+    {"", nil, groupPool, "http://a.example.com/1", "http://group2:1"},
+    {"", nil, groupPool, "http://example.com/2", "http://group1:1"},
+  }
+  for _, c := range cases {
+    p, b, h := collectProxy(t, c.rule, c.pool, c.gp, c.addr)
+    if p.Proxy() != c.want {
+      t.Fatalf("%+v: want %q, got %q", c, c.want, p.Proxy())
+    }
+    if v, ok := h.record[RecordProxy]; ok != (c.want != "") || (ok && v != c.want) {
+      t.Fatalf("%+v: unexpected record proxy %v", c, v)
+    }
+    // 使用代理时在独立的BrowserContext中打开
+    var want []string
+    if c.want != "" {
+      want = []string{c.want}
+    }
+    if !reflect.DeepEqual(b.proxies, want) {
+      t.Fatalf("%+v: want contexts %v, got %v", c, want, b.proxies)
+    }
+  }
+}
+
+func TestProxyPoolHosts(t *testing.T) {
+  pp, _ := NewProxyPool([]string{"http://a:1", "http://b:1"}, 0)
+  pp.hostTTL = time.Millisecond * 50
+  pp.maxHosts = 2
+  pp.get("x")
+  pp.get("y")
+  pp.get("x")
+  // 达到上限时移除最久没有使用的（y）
+  pp.get("z")
+  if len(pp.hosts) != 2 || pp.hosts["y"] != nil {
+    t.Fatalf("unexpected hosts %v", pp.hosts)
+  }
+  // 过期后重新分配
+  time.Sleep(pp.hostTTL)
+  if got, _ := pp.get("x"); got != "http://b:1" {
+    t.Fatalf("want http://b:1, got %s", got)
+  }
+  pp.get("w")
+  if len(pp.hosts) != 2 || pp.hosts["z"] != nil {
+    t.Fatalf("expired host not removed %v", pp.hosts)
+  }
+}
+
+// Tab被关闭或加载超时都计为代理失败
+func TestProxyFailure(t *testing.T) {
+  for _, closed := range []bool{true, false} {
+    pp, _ := NewProxyPool([]string{"http://a:1"}, 1)
+    rg := NewRuleGroup("g")
+    if e := rg.AppendBytes([]byte(fmt.Sprintf(proxyRule, "") + "timeout: \"50ms\"\n")); e != nil {
+      t.Fatal(e)
+    }
+    p := NewPage("http://example.com/1", "g")
+    p.ProxyPool = pp
+    p.newContext = func(h cdp.Handler, proxy string) (cdpTab, error) {
+      tab := newFakeTab(h, nil)
+      tab.noLoad = true
+      if closed {
+        tab.Close()
+      }
+      return tab, nil
+    }
+    h := &recordHandler{done: make(chan struct{})}
+    if e := p.collect(context.Background(), fakeNewTab(nil), rg, h); e != nil {
+      t.Fatal(e)
+    }
+    select {
+    case <-h.done:
+    case <-time.After(time.Second * 5):
+      t.Fatal("timeout")
+    }
+    if len(pp.Healthy()) != 0 {
+      t.Fatalf("closed %v: proxy not failed", closed)
+    }
+  }
+}
+
+func TestProxyNoHealthy(t *testing.T) {
+  pp, _ := NewProxyPool([]string{"http://a:1"}, 1)
+  pp.fail("http://a:1")
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(fmt.Sprintf(proxyRule, ""))); e != nil {
+    t.Fatal(e)
+  }
+  p := NewPage("http://example.com/1", "g")
+  p.ProxyPool = pp
+  b := newFakeBrowser(t, nil)
+  p.newContext = b.newContext()
+  if e := p.collect(context.Background(), b.newTab(), rg, &recordHandler{}); e != ErrNoProxy {
+    t.Fatalf("want ErrNoProxy, got %v", e)
+  }
+}
+
+func TestValidateProxy(t *testing.T) {
+  _, e := ParseRule([]byte(fmt.Sprintf(proxyRule, "http://u:p@127.0.0.1:8080")))
+  if e == nil || !strings.Contains(e.Error(), "proxy: invalid proxy") {
+    t.Fatalf("unexpected %v", e)
+  }
+}
@@ -0,0 +1,189 @@
+package collector
+
+import (
+  "encoding/json"
+  "fmt"
+  "math"
+  "strconv"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/conv"
+)
+
+// Field和Loop的type可选值，
+// 值的类型分别对应string、int、float64、bool、interface{}（JSON解码后的值）、[]interface{}、map[string]interface{}，
+// 不设置type时与以前一致，任何返回值都会被转为字符串
+const (
+  TypeString = "string"
+  TypeInt    = "int"
+  TypeFloat  = "float"
+  TypeBool   = "bool"
+  TypeJson   = "json"
+  TypeArray  = "array"
+  TypeObject = "object"
+)
+
+// 字段名-->字段值，值的类型由Field.Type决定
+type Record map[string]interface{}
+
+func (r Record) String(name string) string {
+  return conv.String(r[name], "")
+}
+
+func (r Record) Int(name string) int {
+  return conv.Int(r[name], 0)
+}
+
+func (r Record) Float(name string) float64 {
+  if v, ok := r[name].(float64); ok {
+    return v
+  }
+  return 0
+}
+
+func (r Record) Bool(name string) bool {
+  v, _ := r[name].(bool)
+  return v
+}
+
+// 返回值类型与type不一致
+type TypeMismatchError struct {
+  Want string
+  Got  string
+}
+
+func (e *TypeMismatchError) Error() string {
+  return fmt.Sprintf("type mismatch: want %s, got %s", e.Want, e.Got)
+}
+
+// Runtime.evaluate（returnByValue为true）返回的值，
+// undefined没有value字段，返回nil
+func resultValue(msg *cdp.Message) interface{} {
+  if rs, ok := msg.Result["result"].(map[string]interface{}); ok {
+    return rs["value"]
+  }
+  return nil
+}
+
+// Javascript中的真值（returnByValue的结果），undefined和null为nil
+func truthy(v interface{}) bool {
+  switch val := v.(type) {
+  case nil:
+    return false
+  case bool:
+    return val
+  case float64:
+    return val != 0 && !math.IsNaN(val)
+  case string:
+    return val != ""
+  }
+  return true
+}
+
+// 把返回值转换为type指定的类型
+func convertValue(typ string, v interface{}) (interface{}, error) {
+  switch typ {
+  case "":
+    return conv.String(v, ""), nil
+
+  case TypeString:
+    if s, ok := v.(string); ok {
+      return s, nil
+    }
+
+  case TypeInt:
+    if f, ok := v.(float64); ok && f == math.Trunc(f) {
+      return int(f), nil
+    }
+
+  case TypeFloat:
+    if f, ok := v.(float64); ok {
+      return f, nil
+    }
+
+  case TypeBool:
+    if b, ok := v.(bool); ok {
+      return b, nil
+    }
+
+  case TypeJson:
+    // 兼容以前JSON.stringify()的写法
+    if s, ok := v.(string); ok {
+      var ret interface{}
+      if e := json.Unmarshal([]byte(s), &ret); e != nil {
+        return nil, e
+      }
+      return ret, nil
+    }
+    return v, nil
+
+  case TypeArray:
+    if arr, ok := v.([]interface{}); ok {
+      return arr, nil
+    }
+
+  case TypeObject:
+    if m, ok := v.(map[string]interface{}); ok {
+      return m, nil
+    }
+
+  default:
+    return nil, fmt.Errorf("unknown type %q", typ)
+  }
+  return nil, &TypeMismatchError{Want: typ, Got: typeOf(v)}
+}
+
+// 把常量（Field.Value）转换为type指定的类型
+func parseValue(typ, s string) (interface{}, error) {
+  switch typ {
+  case TypeInt:
+    i, e := strconv.Atoi(s)
+    if e != nil {
+      return nil, &TypeMismatchError{Want: typ, Got: TypeString}
+    }
+    return i, nil
+
+  case TypeFloat:
+    f, e := strconv.ParseFloat(s, 64)
+    if e != nil {
+      return nil, &TypeMismatchError{Want: typ, Got: TypeString}
+    }
+    return f, nil
+
+  case TypeBool:
+    b, e := strconv.ParseBool(s)
+    if e != nil {
+      return nil, &TypeMismatchError{Want: typ, Got: TypeString}
+    }
+    return b, nil
+
+  case TypeJson, TypeArray, TypeObject:
+    var v interface{}
+    if e := json.Unmarshal([]byte(s), &v); e != nil {
+      return nil, e
+    }
+    return convertValue(typ, v)
+  }
+  return convertValue(typ, s)
+}
+
+func typeOf(v interface{}) string {
+  switch val := v.(type) {
+  case nil:
+    return "undefined"
+  case string:
+    return TypeString
+  case float64:
+    if val == math.Trunc(val) {
+      return TypeInt
+    }
+    return TypeFloat
+  case bool:
+    return TypeBool
+  case []interface{}:
+    return TypeArray
+  case map[string]interface{}:
+    return TypeObject
+  }
+  return fmt.Sprintf("%T", v)
+}
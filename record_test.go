@@ -0,0 +1,66 @@
+package collector
+
+import (
+  "reflect"
+  "testing"
+)
+
+func TestConvertValue(t *testing.T) {
+  cases := []struct {
+    typ  string
+    in   interface{}
+    want interface{}
+  }{
+    {"", "a", "a"},
+    {"", float64(1), "1.00"},
+    {"", nil, ""},
+    {TypeString, "a", "a"},
+    {TypeInt, float64(12), 12},
+    {TypeFloat, 1.5, 1.5},
+    {TypeBool, true, true},
+    {TypeJson, `{"a":[1,2]}`, map[string]interface{}{"a": []interface{}{float64(1), float64(2)}}},
+    {TypeJson, float64(3), float64(3)},
+    {TypeArray, []interface{}{"x"}, []interface{}{"x"}},
+    {TypeObject, map[string]interface{}{"k": "v"}, map[string]interface{}{"k": "v"}},
+  }
+  for _, c := range cases {
+    v, e := convertValue(c.typ, c.in)
+    if e != nil {
+      t.Fatalf("%s %v: %v", c.typ, c.in, e)
+    }
+    if !reflect.DeepEqual(v, c.want) {
+      t.Fatalf("%s %v: want %#v, got %#v", c.typ, c.in, c.want, v)
+    }
+  }
+
+  mismatches := []struct {
+    typ string
+    in  interface{}
+  }{
+    {TypeString, float64(1)},
+    {TypeInt, 1.5},
+    {TypeInt, "1"},
+    {TypeBool, "true"},
+    {TypeArray, map[string]interface{}{}},
+    {TypeObject, nil},
+  }
+  for _, c := range mismatches {
+    if _, e := convertValue(c.typ, c.in); e == nil {
+      t.Fatalf("%s %v: want error", c.typ, c.in)
+    } else if _, ok := e.(*TypeMismatchError); !ok {
+      t.Fatalf("%s %v: want *TypeMismatchError, got %v", c.typ, c.in, e)
+    }
+  }
+}
+
+func TestParseValue(t *testing.T) {
+  if v, e := parseValue(TypeInt, "1234"); e != nil || v != 1234 {
+    t.Fatal(v, e)
+  }
+  if v, e := parseValue(TypeArray, `["a"]`); e != nil || !reflect.DeepEqual(v, []interface{}{"a"}) {
+    t.Fatal(v, e)
+  }
+  if _, e := parseValue(TypeBool, "yes"); e == nil {
+    t.Fatal("want error")
+  }
+}
@@ -0,0 +1,373 @@
+package collector
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "regexp"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/conv"
+)
+
+// loop没有设置all，但两次循环之间捕获到了多个响应
+var ErrMultipleResponses = errors.New("multiple responses captured")
+
+// 等待响应超时
+type ResponseError struct {
+  Name    string
+  Timeout time.Duration
+}
+
+func (e *ResponseError) Error() string {
+  return fmt.Sprintf("no response %s captured in %s", e.Name, e.Timeout)
+}
+
+// 捕获页面发出的请求（如XHR/fetch）的响应，
+// field或loop通过response引用（name）
+type Response struct {
+  Name string `yaml:"name"`
+
+  // 请求URL的正则表达式
+  Url string         `yaml:"url"`
+  url *regexp.Regexp `yaml:"-"`
+
+  // 请求方法（如GET、POST），为空表示不限
+  Method string `yaml:"method"`
+
+  // 响应的Content-Type（mimeType）包含该字符串，为空表示不限
+  ContentType string `yaml:"content_type"`
+
+  // JSONPath（如$.data.items[*].name），只对JSON（或JSONP）响应有效
+  Path string    `yaml:"path"`
+  path *jsonPath `yaml:"-"`
+
+  // 引用时还没有捕获到响应的等待时间（默认为10s）
+  Timeout string        `yaml:"timeout"`
+  timeout time.Duration `yaml:"-"`
+}
+
+func (r *Response) init() {
+  r.url, _ = regexp.Compile(r.Url)
+  if r.Path != "" {
+    r.path, _ = compileJSONPath(r.Path)
+  }
+  r.timeout = time.Second * 10
+  if r.Timeout != "" {
+    r.timeout, _ = time.ParseDuration(r.Timeout)
+  }
+}
+
+// name是否重复由Rule.Validate检查
+func (r *Response) validate(v *validator, path ...interface{}) {
+  if r.Name == "" {
+    v.add("name is required", sub(path, "name")...)
+  }
+  if r.Url == "" {
+    v.add("url is required", sub(path, "url")...)
+  } else if _, e := regexp.Compile(r.Url); e != nil {
+    v.add(e.Error(), sub(path, "url")...)
+  }
+  if r.Path != "" {
+    if _, e := compileJSONPath(r.Path); e != nil {
+      v.add(e.Error(), sub(path, "path")...)
+    }
+  }
+  v.positive(r.Timeout, sub(path, "timeout")...)
+}
+
+func (r *Response) match(method, url, mimeType string) bool {
+  if r.Method != "" && !strings.EqualFold(r.Method, method) {
+    return false
+  }
+  if r.ContentType != "" && !strings.Contains(mimeType, r.ContentType) {
+    return false
+  }
+  return r.url.MatchString(url)
+}
+
+// 解析响应内容，JSON（或JSONP）会被解析，否则为字符串
+func (r *Response) parse(body string) (interface{}, error) {
+  var v interface{}
+  if e := json.Unmarshal([]byte(body), &v); e != nil {
+    if s := unwrapJsonp(body); s == "" || json.Unmarshal([]byte(s), &v) != nil {
+      if r.path != nil {
+        return nil, fmt.Errorf("response %s is not json", r.Name)
+      }
+      return body, nil
+    }
+  }
+  if r.path != nil {
+    return r.path.eval(v)
+  }
+  return v, nil
+}
+
+// JSONP（如callback({...});）去掉函数调用，不是JSONP时返回空字符串
+func unwrapJsonp(s string) string {
+  s = strings.TrimSpace(s)
+  i := strings.IndexByte(s, '(')
+  if i <= 0 || !jsonpRegexp.MatchString(s[:i]) {
+    return ""
+  }
+  s = strings.TrimSuffix(strings.TrimSpace(s[i+1:]), ";")
+  if !strings.HasSuffix(s, ")") {
+    return ""
+  }
+  return s[:len(s)-1]
+}
+
+var jsonpRegexp = regexp.MustCompile(`^\s*[A-Za-z_$][A-Za-z0-9_$.]*\s*$`)
+
+type capture struct {
+  v   interface{}
+  err error
+}
+
+// 一次尝试中捕获到的响应
+type captures struct {
+  rules []*Response
+
+  // 还没有结束的请求，Network事件在不同的goroutine中分发，到达顺序不确定
+  requests map[string]*networkRequest
+
+  // 正在获取内容的请求匹配的规则
+  matched map[string]*Response
+
+  values map[string][]*capture
+
+  // loop已经使用过的个数
+  used map[string]int
+
+  // 有新的响应时关闭并替换
+  notify chan struct{}
+
+  mu sync.Mutex
+}
+
+// 一个请求已经收到的事件
+type networkRequest struct {
+  method   string
+  url      string
+  mimeType string
+
+  sent     bool
+  received bool
+  finished bool
+  failed   bool
+
+  // 收到requestWillBeSent和responseReceived之后匹配
+  checked bool
+  rule    *Response
+}
+
+func newCaptures(rules []*Response) *captures {
+  return &captures{
+    rules:    rules,
+    requests: make(map[string]*networkRequest, 16),
+    matched:  make(map[string]*Response, 4),
+    values:   make(map[string][]*capture, len(rules)),
+    used:     make(map[string]int, len(rules)),
+    notify:   make(chan struct{}),
+  }
+}
+
+// 处理Network事件，返回需要获取内容的requestId（匹配的请求的事件都收到之后）
+func (c *captures) onEvent(msg *cdp.Message) string {
+  id := conv.GetString(msg.Params, "requestId", "")
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  r := c.requests[id]
+  if r == nil {
+    r = &networkRequest{}
+    c.requests[id] = r
+  }
+  switch msg.Method {
+  case cdp.Network.RequestWillBeSent:
+    r.sent = true
+    r.method = conv.GetString(conv.GetMap(msg.Params, "request"), "method", "")
+  case cdp.Network.ResponseReceived:
+    resp := conv.GetMap(msg.Params, "response")
+    r.received = true
+    r.url, r.mimeType = conv.GetString(resp, "url", ""), conv.GetString(resp, "mimeType", "")
+  case cdp.Network.LoadingFinished:
+    r.finished = true
+  case cdp.Network.LoadingFailed:
+    r.failed = true
+  }
+  if !r.sent {
+    return ""
+  }
+  if r.failed {
+    // 失败的请求可能没有responseReceived
+    delete(c.requests, id)
+    return ""
+  }
+  if !r.received {
+    return ""
+  }
+  if !r.checked {
+    r.checked = true
+    for _, rule := range c.rules {
+      if rule.match(r.method, r.url, r.mimeType) {
+        r.rule = rule
+        break
+      }
+    }
+  }
+  if !r.finished {
+    return ""
+  }
+  delete(c.requests, id)
+  if r.rule == nil {
+    return ""
+  }
+  c.matched[id] = r.rule
+  return id
+}
+
+// 处理Network.getResponseBody的结果
+func (c *captures) add(id string, msg *cdp.Message, e error) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  r, ok := c.matched[id]
+  if !ok {
+    return
+  }
+  delete(c.matched, id)
+  ca := &capture{err: e}
+  if e == nil {
+    body := conv.GetString(msg.Result, "body", "")
+    if conv.GetBool(msg.Result, "base64Encoded", false) {
+      b, e := base64.StdEncoding.DecodeString(body)
+      if e != nil {
+        ca.err = e
+      }
+      body = string(b)
+    }
+    if ca.err == nil {
+      ca.v, ca.err = r.parse(body)
+    }
+  }
+  c.values[r.Name] = append(c.values[r.Name], ca)
+  close(c.notify)
+  c.notify = make(chan struct{})
+}
+
+// 捕获到的第used个之后的响应，没有时返回nil和用于等待的chan
+func (c *captures) since(name string, used int) ([]*capture, chan struct{}) {
+  c.mu.Lock()
+  defer c.mu.Unlock()
+  if vs := c.values[name]; len(vs) > used {
+    return vs[used:], nil
+  }
+  return nil, c.notify
+}
+
+func (c *captures) rule(name string) *Response {
+  for _, r := range c.rules {
+    if r.Name == name {
+      return r
+    }
+  }
+  return nil
+}
+
+// 获取响应内容（不阻塞事件处理）
+func (a *attempt) fetchBody(id string) {
+  _, ch := a.tab.Call(cdp.Network.GetResponseBody, map[string]interface{}{"requestId": id})
+  if ch == nil {
+    a.captures.add(id, nil, ErrTabClosed)
+    return
+  }
+  go func() {
+    select {
+    case msg := <-ch:
+      a.captures.add(id, msg, checkResult(msg))
+    case <-a.p.done:
+    }
+  }()
+}
+
+// 等待第used个之后的响应，超时返回*ResponseError
+func (p *Page) waitResponse(name string, used int) ([]*capture, error) {
+  c := p.current().captures
+  r := c.rule(name)
+  deadline := time.Now().Add(r.timeout)
+  for {
+    vs, ch := c.since(name, used)
+    if vs != nil {
+      return vs, nil
+    }
+    d := time.Until(deadline)
+    if d <= 0 {
+      return nil, &ResponseError{Name: name, Timeout: r.timeout}
+    }
+    t := timers.afterFunc(d, func() {
+      c.mu.Lock()
+      defer c.mu.Unlock()
+      if ch == c.notify {
+        close(c.notify)
+        c.notify = make(chan struct{})
+      }
+    })
+    select {
+    case <-ch:
+      timers.stop(t)
+    case <-p.ctx.Done():
+      timers.stop(t)
+      return nil, p.ctx.Err()
+    }
+  }
+}
+
+// field的值，all为true时返回所有捕获到的响应（数组），否则返回最后一个
+func (p *Page) responseValue(name string, all bool) (interface{}, error) {
+  vs, e := p.waitResponse(name, 0)
+  if e != nil {
+    return nil, e
+  }
+  if !all {
+    ca := vs[len(vs)-1]
+    return ca.v, ca.err
+  }
+  return values(vs)
+}
+
+func values(vs []*capture) (interface{}, error) {
+  ret := make([]interface{}, 0, len(vs))
+  for _, ca := range vs {
+    if ca.err != nil {
+      return nil, ca.err
+    }
+    ret = append(ret, ca.v)
+  }
+  return ret, nil
+}
+
+// loop每次循环的值，all为true时返回上次循环之后捕获到的所有响应（数组），
+// 否则只能有一个响应（多于一个时返回ErrMultipleResponses，这些响应都被丢弃）
+func (p *Page) loopResponse(name string, all bool) (interface{}, error) {
+  c := p.current().captures
+  c.mu.Lock()
+  used := c.used[name]
+  c.mu.Unlock()
+  vs, e := p.waitResponse(name, used)
+  if e != nil {
+    return nil, e
+  }
+  c.mu.Lock()
+  c.used[name] = used + len(vs)
+  c.mu.Unlock()
+  if all {
+    return values(vs)
+  }
+  if len(vs) > 1 {
+    return nil, fmt.Errorf("%w: %s got %d", ErrMultipleResponses, name, len(vs))
+  }
+  return vs[0].v, vs[0].err
+}
@@ -0,0 +1,266 @@
+package collector
+
+import (
+  "context"
+  "errors"
+  "fmt"
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+func TestJSONPath(t *testing.T) {
+  doc := map[string]interface{}{
+    "data": map[string]interface{}{
+      "items": []interface{}{
+        map[string]interface{}{"name": "a", "price": 1.0},
+        map[string]interface{}{"name": "b"},
+      },
+      "total": 2.0,
+    },
+  }
+  cases := []struct {
+    path string
+    want interface{}
+  }{
+    {"$", doc},
+    {"$.data.total", 2.0},
+    {"$['data'][\"total\"]", 2.0},
+    {"$.data.items[1].name", "b"},
+    {"$.data.items[-1].name", "b"},
+    {"$.data.items[*].name", []interface{}{"a", "b"}},
+    {"$.data.items[*].price", []interface{}{1.0}},
+    {"$.data.items[0].*", []interface{}{"a", 1.0}},
+  }
+  for _, c := range cases {
+    p, e := compileJSONPath(c.path)
+    if e != nil {
+      t.Fatalf("%s: %v", c.path, e)
+    }
+    got, e := p.eval(doc)
+    if e != nil || !reflect.DeepEqual(got, c.want) {
+      t.Errorf("%s: want %v, got %v (%v)", c.path, c.want, got, e)
+    }
+  }
+  p, _ := compileJSONPath("$.data.nope")
+  if _, e := p.eval(doc); !errors.Is(e, ErrPathNotFound) {
+    t.Errorf("want ErrPathNotFound, got %v", e)
+  }
+  for _, s := range []string{"", "data", "$.", "$[", "$[x]", "$a"} {
+    if _, e := compileJSONPath(s); e == nil {
+      t.Errorf("%q: want error", s)
+    }
+  }
+}
+
+func TestUnwrapJsonp(t *testing.T) {
+  cases := map[string]string{
+    `fetchJSON_comment98({"a":1});`: `{"a":1}`,
+    ` cb ( [1] ) `:                  `[1] `,
+    `{"a":1}`:                       "",
+    `var a = b(1)`:                  "",
+  }
+  for in, want := range cases {
+    if got := unwrapJsonp(in); got != want {
+      t.Errorf("%q: want %q, got %q", in, want, got)
+    }
+  }
+}
+
+var responseRule = `id: "r"
+group: "g"
+patterns: ["example.com"]
+responses:
+  - name: "comments"
+    url: "/comments\\?page="
+    method: "GET"
+    path: "$.comments[*].content"
+  - name: "total"
+    url: "/total"
+    content_type: "json"
+    path: "$.total"
+fields:
+  - name: "total"
+    response: "total"
+    type: "int"
+    export: true
+  - name: "first"
+    response: "comments"
+    type: "array"
+    export: true
+loop:
+  name: "comments"
+  response: "comments"
+  type: "array"
+  export_cycle: 1
+  next: "true"
+`
+
+type loopHandler struct {
+  recordHandler
+  loops [][]interface{}
+}
+
+func (h *loopHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  h.loops = append(h.loops, data)
+  return i < 2
+}
+
+func TestResponses(t *testing.T) {
+  for _, reverse := range []bool{false, true} {
+    testResponses(t, reverse)
+  }
+}
+
+func testResponses(t *testing.T, reverse bool) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(responseRule)); e != nil {
+    t.Fatal(e)
+  }
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    tab := newFakeTab(h, func(string) interface{} { return "true" })
+    tab.reverse = reverse
+    tab.requests = []*fakeRequest{
+      {method: "GET", url: "http://example.com/total", mimeType: "application/json", body: `{"total":42}`},
+      {method: "POST", url: "http://example.com/comments?page=0", body: `{"comments":[{"content":"x"}]}`},
+      {method: "GET", url: "http://example.com/comments?page=1", body: `cb({"comments":[{"content":"a"},{"content":"b"}]})`},
+      {method: "GET", url: "http://example.com/comments?page=2", body: `{"comments":[{"content":"c"}]}`, delay: time.Millisecond * 50},
+    }
+    return tab, nil
+  }
+  p := NewPage("http://example.com", "g")
+  h := &loopHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if p.Err() != nil {
+    t.Fatal(p.Err())
+  }
+  if h.record["total"] != 42 {
+    t.Fatalf("want total 42, got %v", h.record["total"])
+  }
+  want := [][]interface{}{
+    {[]interface{}{"a", "b"}},
+    {[]interface{}{"c"}},
+  }
+  // field和第一次循环都使用当时捕获到的最后一个响应
+  if first := h.record["first"]; !reflect.DeepEqual(first, want[0][0]) {
+    t.Fatalf("want first %v, got %v", want[0][0], first)
+  }
+  if !reflect.DeepEqual(h.loops, want) {
+    t.Fatalf("want loops %v, got %v", want, h.loops)
+  }
+}
+
+// 每个请求的Network事件以任意顺序到达，匹配的请求都只获取一次内容
+func TestCapturesEventOrder(t *testing.T) {
+  rules := []*Response{{Name: "a", Url: "/a", Method: "GET"}}
+  for _, r := range rules {
+    r.init()
+  }
+  events := func(id, method, url string) []*cdp.Message {
+    return []*cdp.Message{
+      {Method: cdp.Network.RequestWillBeSent, Params: map[string]interface{}{
+        "requestId": id, "request": map[string]interface{}{"method": method, "url": url},
+      }},
+      {Method: cdp.Network.ResponseReceived, Params: map[string]interface{}{
+        "requestId": id, "response": map[string]interface{}{"url": url},
+      }},
+      {Method: cdp.Network.LoadingFinished, Params: map[string]interface{}{"requestId": id}},
+    }
+  }
+  orders := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 0, 2}, {1, 2, 0}, {2, 0, 1}, {2, 1, 0}}
+  for _, order := range orders {
+    c := newCaptures(rules)
+    var fetched []string
+    for _, req := range [][]*cdp.Message{events("1", "GET", "http://x/a"), events("2", "POST", "http://x/a"), events("3", "GET", "http://x/b")} {
+      for _, i := range order {
+        if id := c.onEvent(req[i]); id != "" {
+          fetched = append(fetched, id)
+        }
+      }
+    }
+    if !reflect.DeepEqual(fetched, []string{"1"}) {
+      t.Fatalf("order %v: want [1] fetched, got %v", order, fetched)
+    }
+    if len(c.requests) != 0 || len(c.matched) != 1 {
+      t.Fatalf("order %v: leaked %d requests, %d matched", order, len(c.requests), len(c.matched))
+    }
+  }
+  // 失败的请求（可能没有responseReceived）
+  c := newCaptures(rules)
+  c.onEvent(&cdp.Message{Method: cdp.Network.LoadingFailed, Params: map[string]interface{}{"requestId": "1"}})
+  c.onEvent(events("1", "GET", "http://x/a")[0])
+  if len(c.requests) != 0 || len(c.matched) != 0 {
+    t.Fatalf("failed request leaked")
+  }
+}
+
+// 两次循环之间有多个响应：all为true时全部返回，否则报错
+func TestLoopResponses(t *testing.T) {
+  for _, all := range []bool{true, false} {
+    rg := NewRuleGroup("g")
+    rule := strings.Replace(responseRule, `  response: "comments"
+  type: "array"
+  export_cycle: 1`, fmt.Sprintf(`  response: "comments"
+  type: "array"
+  all: %v
+  prepare:
+    wait: "100ms"
+  export_cycle: 1`, all), 1)
+    if e := rg.AppendBytes([]byte(rule)); e != nil {
+      t.Fatal(e)
+    }
+    newTab := func(h cdp.Handler) (cdpTab, error) {
+      tab := newFakeTab(h, func(string) interface{} { return "true" })
+      tab.requests = []*fakeRequest{
+        {method: "GET", url: "http://example.com/total", mimeType: "application/json", body: `{"total":42}`},
+        {method: "GET", url: "http://example.com/comments?page=1", body: `{"comments":[{"content":"a"}]}`},
+        {method: "GET", url: "http://example.com/comments?page=2", body: `{"comments":[{"content":"b"}]}`, delay: time.Millisecond * 20},
+        {method: "GET", url: "http://example.com/comments?page=3", body: `{"comments":[{"content":"c"}]}`, delay: time.Millisecond * 150},
+      }
+      return tab, nil
+    }
+    p := NewPage("http://example.com", "g")
+    // loop的prepare等待前两个响应都捕获到
+    h := &loopErrHandler{loopHandler: loopHandler{recordHandler: recordHandler{done: make(chan struct{})}}}
+    if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+      t.Fatal(e)
+    }
+    select {
+    case <-h.done:
+    case <-time.After(time.Second * 5):
+      t.Fatal("timeout")
+    }
+    want := [][]interface{}{
+      {[]interface{}{[]interface{}{"a"}, []interface{}{"b"}}},
+      {[]interface{}{[]interface{}{"c"}}},
+    }
+    if !all {
+      want = [][]interface{}{{nil}, {[]interface{}{"c"}}}
+    }
+    if !reflect.DeepEqual(h.loops, want) {
+      t.Fatalf("all %v: want loops %v, got %v", all, want, h.loops)
+    }
+    if !all && (len(h.errs) != 1 || !errors.Is(h.errs[0], ErrMultipleResponses)) {
+      t.Fatalf("want ErrMultipleResponses, got %v", h.errs)
+    }
+  }
+}
+
+type loopErrHandler struct {
+  loopHandler
+  errs []error
+}
+
+func (h *loopErrHandler) OnError(p *Page, stage Stage, name string, e error) {
+  h.errs = append(h.errs, e)
+}
@@ -0,0 +1,318 @@
+package collector
+
+import (
+  "errors"
+  "fmt"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+var ErrRequiredField = errors.New("required field is empty")
+
+// 可重试的失败类型（retry.on）
+const (
+  RetryOnTimeout  = "timeout"
+  RetryOnNavigate = "navigate"
+  RetryOnPrepare  = "prepare"
+  RetryOnEval     = "eval"
+  RetryOnRequired = "required"
+)
+
+// 重试全部失败后Page.Err()返回的错误
+type RetryError struct {
+  Attempts int
+
+  // 最后一次尝试的错误
+  Err error
+
+  // 每次尝试（按顺序）第一个可重试的错误，最后一个即Err
+  Errs []error
+}
+
+func (e *RetryError) Error() string {
+  return fmt.Sprintf("failed after %d attempts: %v", e.Attempts, e.Err)
+}
+
+func (e *RetryError) Unwrap() error {
+  return e.Err
+}
+
+type Retry struct {
+  // 最大尝试次数（包括第一次），默认为3
+  MaxAttempts int `yaml:"max_attempts"`
+
+  // 第一次重试前的等待时间（默认为1s），之后每次翻倍，但不超过max_backoff
+  Backoff    string        `yaml:"backoff"`
+  backoff    time.Duration `yaml:"-"`
+  MaxBackoff string        `yaml:"max_backoff"`
+  maxBackoff time.Duration `yaml:"-"`
+
+  // 哪些失败需要重试（timeout、navigate、prepare、eval、required），为空表示全部
+  On []string `yaml:"on"`
+
+  // 这些字段（必须是export的）为空时视为失败
+  Required []string `yaml:"required"`
+}
+
+func (r *Retry) init() {
+  if r == nil {
+    return
+  }
+  if r.MaxAttempts == 0 {
+    r.MaxAttempts = 3
+  }
+  r.backoff = time.Second
+  if r.Backoff != "" {
+    r.backoff, _ = time.ParseDuration(r.Backoff)
+  }
+  if r.MaxBackoff != "" {
+    r.maxBackoff, _ = time.ParseDuration(r.MaxBackoff)
+  }
+}
+
+// names为fields中（合法且不重复的）name对应的下标
+func (r *Retry) validate(v *validator, fields []*Field, names map[string]int, path ...interface{}) {
+  if r == nil {
+    return
+  }
+  if r.MaxAttempts < 0 {
+    v.add("max_attempts must not be negative", sub(path, "max_attempts")...)
+  }
+  v.duration(r.Backoff, sub(path, "backoff")...)
+  v.duration(r.MaxBackoff, sub(path, "max_backoff")...)
+  for i, k := range r.On {
+    switch k {
+    case RetryOnTimeout, RetryOnNavigate, RetryOnPrepare, RetryOnEval, RetryOnRequired:
+    default:
+      v.add(fmt.Sprintf("unknown retry condition %q", k), sub(path, "on", i)...)
+    }
+  }
+  for i, name := range r.Required {
+    if j, ok := names[name]; !ok {
+      v.add(fmt.Sprintf("required field %q not found", name), sub(path, "required", i)...)
+    } else if !fields[j].Export {
+      v.add(fmt.Sprintf("required field %q is not exported", name), sub(path, "required", i)...)
+    }
+  }
+}
+
+func (r *Retry) retryable(kind string) bool {
+  if kind == "" {
+    return false
+  }
+  if len(r.On) == 0 {
+    return true
+  }
+  for _, k := range r.On {
+    if k == kind {
+      return true
+    }
+  }
+  return false
+}
+
+// 第n次尝试失败后的等待时间
+func (r *Retry) delay(n int) time.Duration {
+  d := r.backoff
+  for i := 1; i < n; i++ {
+    d *= 2
+    if r.maxBackoff > 0 && d >= r.maxBackoff {
+      break
+    }
+  }
+  if r.maxBackoff > 0 && d > r.maxBackoff {
+    d = r.maxBackoff
+  }
+  return d
+}
+
+// 失败的类型，不可重试的返回空字符串
+func failureKind(stage Stage, e error) string {
+  if errors.Is(e, ErrRequiredField) {
+    return RetryOnRequired
+  }
+  switch stage {
+  case StageLoad:
+    return RetryOnTimeout
+  case StageNavigate:
+    return RetryOnNavigate
+  case StagePrepare:
+    return RetryOnPrepare
+  case StageField:
+    return RetryOnEval
+  }
+  return ""
+}
+
+// 一次尝试（每次都使用新的Tab），
+// 作为Tab的cdp.Handler，旧Tab的事件不会影响新的尝试
+type attempt struct {
+  p   *Page
+  n   int
+  tab cdpTab
+
+  // 页面加载超时的定时器
+  timeout *timer
+
+  // 进行中的请求（只有需要network_idle时才会记录）
+  network *network
+
+  // 捕获到的响应（只有规则中有responses时才会记录）
+  captures *captures
+
+  // 使用的代理及分配该代理的ProxyPool
+  proxy     string
+  pool      *ProxyPool
+  proxyOnce sync.Once
+
+  started time.Time
+
+  // Page.navigate返回的frameId和loaderId，以及在此之前收到的生命周期事件
+  frameId   string
+  loaderId  string
+  lifecycle []lifecycle
+
+  timeoutFired bool
+
+  // prepare阶段的capture，确定不再重试后才回调（被丢弃的尝试不回调）
+  prepared []*Snapshot
+
+  once sync.Once
+
+  kinds []string
+  errs  []error
+  mu    sync.Mutex
+}
+
+func (a *attempt) OnCdpEvent(msg *cdp.Message) {
+  if msg.Method == fetchRequestPaused {
+    a.onRequestPaused(msg)
+    return
+  }
+  if a.network != nil {
+    a.network.onEvent(msg)
+  }
+  if a.captures != nil {
+    if id := a.captures.onEvent(msg); id != "" {
+      a.fetchBody(id)
+    }
+  }
+  if msg.Method == loadTimeoutEvent {
+    a.mu.Lock()
+    a.timeoutFired = true
+    a.mu.Unlock()
+    if !a.p.isDone() {
+      a.p.reportTo(a, StageLoad, "", ErrLoadTimeout)
+    }
+    a.proxyResult(ErrLoadTimeout)
+    a.load()
+  } else if a.triggered(msg) {
+    a.load()
+  }
+}
+
+// 如果超时，就有可能存在两次回调（超时一次回调和正常一次回调），
+// once是为了防止重复调用
+func (a *attempt) load() {
+  a.once.Do(func() {
+    a.p.run(a)
+  })
+}
+
+func (a *attempt) timedOut() bool {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  return a.timeoutFired
+}
+
+func (a *attempt) OnCdpResponse(msg *cdp.Message) bool {
+  return false
+}
+
+func (a *attempt) fail(stage Stage, e error) {
+  if a == nil {
+    return
+  }
+  a.mu.Lock()
+  a.kinds = append(a.kinds, failureKind(stage, e))
+  a.errs = append(a.errs, e)
+  a.mu.Unlock()
+}
+
+// 第一个可重试的错误
+func (a *attempt) failure(r *Retry) error {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  for i, k := range a.kinds {
+    if r.retryable(k) {
+      return a.errs[i]
+    }
+  }
+  return nil
+}
+
+// 如果第a次尝试有可重试的失败且还有剩余次数，关闭当前Tab，
+// 等待后在新的Tab中重新采集，返回是否重试
+func (p *Page) retry(a *attempt) bool {
+  r := p.Rule.Retry
+  if r == nil || p.ctx.Err() != nil || a.n >= r.MaxAttempts || a.failure(r) == nil {
+    return false
+  }
+  p.mu.Lock()
+  p.failures = append(p.failures, a.failure(r))
+  p.mu.Unlock()
+  timers.stop(a.timeout)
+  a.tab.Close()
+  go func() {
+    if e := p.sleep(r.delay(a.n)); e == nil {
+      if e = p.start(a.n + 1); e == nil {
+        return
+      }
+      p.setErr(e)
+    }
+    p.finish()
+  }()
+  return true
+}
+
+// 重试次数用完后仍失败，记录错误（OnFields仍会回调，但结果可能不完整）
+func (p *Page) checkAttempts(a *attempt) {
+  r := p.Rule.Retry
+  if r == nil {
+    return
+  }
+  if e := a.failure(r); e != nil {
+    p.mu.Lock()
+    errs := append(append([]error(nil), p.failures...), e)
+    p.mu.Unlock()
+    p.setErr(&RetryError{Attempts: a.n, Err: e, Errs: errs})
+  }
+}
+
+func (p *Page) checkRequired(m Record) {
+  r := p.Rule.Retry
+  if r == nil {
+    return
+  }
+  for _, name := range r.Required {
+    if isEmpty(m[name]) {
+      p.report(StageField, name, fmt.Errorf("%w: %s", ErrRequiredField, name))
+    }
+  }
+}
+
+func isEmpty(v interface{}) bool {
+  switch val := v.(type) {
+  case nil:
+    return true
+  case string:
+    return val == ""
+  case []interface{}:
+    return len(val) == 0
+  case map[string]interface{}:
+    return len(val) == 0
+  }
+  return false
+}
@@ -0,0 +1,196 @@
+package collector
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+var retryRule = `id: "r"
+group: "g"
+patterns: ["example.com"]
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+retry:
+  max_attempts: 3
+  backoff: "1ms"
+  on: ["required"]
+  required: ["a"]
+`
+
+type recordHandler struct {
+  done   chan struct{}
+  fields int32
+  record Record
+}
+
+func (h *recordHandler) OnFields(p *Page, data Record) {
+  atomic.AddInt32(&h.fields, 1)
+  h.record = data
+}
+
+func (h *recordHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  return false
+}
+
+func (h *recordHandler) OnComplete(p *Page) {
+  close(h.done)
+}
+
+// 前fails个Tab的eval返回空字符串
+func collectWithRetry(t *testing.T, fails int32) (*Page, *recordHandler, int32) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(retryRule)); e != nil {
+    t.Fatal(e)
+  }
+  var tabs int32
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    n := atomic.AddInt32(&tabs, 1)
+    return newFakeTab(h, func(string) interface{} {
+      if n <= fails {
+        return ""
+      }
+      return "ok"
+    }), nil
+  }
+  p := NewPage("http://example.com", "g")
+  h := &recordHandler{done: make(chan struct{})}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  return p, h, atomic.LoadInt32(&tabs)
+}
+
+func TestRetrySucceeded(t *testing.T) {
+  p, h, tabs := collectWithRetry(t, 2)
+  if tabs != 3 {
+    t.Fatalf("want 3 tabs, got %d", tabs)
+  }
+  if h.fields != 1 || h.record["a"] != "ok" {
+    t.Fatalf("want 1 OnFields with a=ok, got %d %v", h.fields, h.record)
+  }
+  if p.Err() != nil {
+    t.Fatal(p.Err())
+  }
+}
+
+func TestRetryExhausted(t *testing.T) {
+  p, h, tabs := collectWithRetry(t, 10)
+  if tabs != 3 {
+    t.Fatalf("want 3 tabs, got %d", tabs)
+  }
+  if h.fields != 1 {
+    t.Fatalf("want 1 OnFields, got %d", h.fields)
+  }
+  var re *RetryError
+  if !errors.As(p.Err(), &re) || re.Attempts != 3 || len(re.Errs) != 3 || !errors.Is(re, ErrRequiredField) {
+    t.Fatalf("want *RetryError, got %v", p.Err())
+  }
+}
+
+func TestRetryNavigateExhausted(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(strings.Replace(retryRule, `["required"]`, `["navigate"]`, 1))); e != nil {
+    t.Fatal(e)
+  }
+  var tabs int32
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    atomic.AddInt32(&tabs, 1)
+    tab := newFakeTab(h, nil)
+    tab.errorText = "net::ERR_CONNECTION_REFUSED"
+    return tab, nil
+  }
+  p := NewPage("http://example.com", "g")
+  h := &recordHandler{done: make(chan struct{})}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if tabs != 3 || h.fields != 1 {
+    t.Fatalf("want 3 tabs and 1 OnFields, got %d and %d", tabs, h.fields)
+  }
+  var re *RetryError
+  var ne *NavigateError
+  if !errors.As(p.Err(), &re) || re.Attempts != 3 || len(re.Errs) != 3 || !errors.As(re, &ne) {
+    t.Fatalf("want *RetryError, got %v", p.Err())
+  }
+}
+
+// 导航时先发出一个带timeout参数的事件
+type eventTab struct {
+  *fakeTab
+}
+
+func (t *eventTab) Call(method string, params map[string]interface{}) (int32, chan *cdp.Message) {
+  if method == cdp.Page.Navigate {
+    t.handler.OnCdpEvent(&cdp.Message{Method: cdp.Network.RequestWillBeSent, Params: map[string]interface{}{"requestId": "1", "timeout": 1.0}})
+  }
+  return t.fakeTab.Call(method, params)
+}
+
+// 页面事件中的timeout参数不是加载超时
+func TestLoadTimeoutEvent(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(retryRule)); e != nil {
+    t.Fatal(e)
+  }
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    return &eventTab{newFakeTab(h, func(string) interface{} { return "ok" })}, nil
+  }
+  p := NewPage("http://example.com", "g")
+  h := &errHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if len(h.errs) != 0 || p.Err() != nil || h.record["a"] != "ok" {
+    t.Fatalf("unexpected errors %v %v", h.errs, p.Err())
+  }
+}
+
+func TestRetryDelay(t *testing.T) {
+  r := &Retry{Backoff: "100ms", MaxBackoff: "1s"}
+  r.init()
+  want := []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond, 800 * time.Millisecond, time.Second, time.Second}
+  for i, d := range want {
+    if got := r.delay(i + 1); got != d {
+      t.Errorf("delay(%d): want %s, got %s", i+1, d, got)
+    }
+  }
+  if r.MaxAttempts != 3 {
+    t.Errorf("want default max_attempts 3, got %d", r.MaxAttempts)
+  }
+}
+
+func TestRetryOn(t *testing.T) {
+  r := &Retry{On: []string{RetryOnTimeout}}
+  if !r.retryable(failureKind(StageLoad, ErrLoadTimeout)) {
+    t.Error("timeout should be retryable")
+  }
+  if r.retryable(failureKind(StageField, ErrRequiredField)) {
+    t.Error("required should not be retryable")
+  }
+  if r.retryable(failureKind(StageLoop, ErrCallFailed)) {
+    t.Error("loop should not be retryable")
+  }
+}
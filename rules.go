@@ -1,23 +1,37 @@
 package collector
 
 import (
+  "bytes"
   "errors"
+  "fmt"
+  "io"
   "io/ioutil"
   "regexp"
   "sort"
+  "strings"
   "sync"
   "time"
 
   "github.com/kwf2030/commons/base"
-  "gopkg.in/yaml.v2"
+  "gopkg.in/yaml.v3"
 )
 
-var ErrDifferentRuleGroup = errors.New("different rule group")
+var (
+  ErrDifferentRuleGroup = errors.New("different rule group")
+  ErrEmptyRule          = errors.New("empty rule")
+)
 
 type RuleGroup struct {
   name  string
   rules []*Rule
-  mu    sync.RWMutex
+
+  // 该分组的所有页面都在独立的BrowserContext中打开
+  isolated bool
+
+  // 规则没有设置proxy时使用
+  proxyPool *ProxyPool
+
+  mu sync.RWMutex
 }
 
 func NewRuleGroup(name string) *RuleGroup {
@@ -43,21 +57,73 @@ func (rg *RuleGroup) match(url string) *Rule {
   return nil
 }
 
+func (rg *RuleGroup) Name() string {
+  return rg.name
+}
+
+// 设置为true时，该分组的每个Tab都在新的BrowserContext（类似隐身窗口）中打开，
+// 与其它Tab不共享cookies、localStorage和缓存，关闭Tab时销毁，
+// 规则也可以单独设置（isolated: true）
+func (rg *RuleGroup) SetIsolated(isolated bool) {
+  rg.mu.Lock()
+  defer rg.mu.Unlock()
+  rg.isolated = isolated
+}
+
+func (rg *RuleGroup) Isolated() bool {
+  rg.mu.RLock()
+  defer rg.mu.RUnlock()
+  return rg.isolated
+}
+
+// 规则没有设置proxy（Page也没有设置ProxyPool）时，从该代理池中分配代理，为nil表示不使用代理
+func (rg *RuleGroup) SetProxyPool(pool *ProxyPool) {
+  rg.mu.Lock()
+  defer rg.mu.Unlock()
+  rg.proxyPool = pool
+}
+
+func (rg *RuleGroup) ProxyPool() *ProxyPool {
+  rg.mu.RLock()
+  defer rg.mu.RUnlock()
+  return rg.proxyPool
+}
+
+// 支持多文档（---分隔）的YAML，所有规则都必须属于该分组，
+// 有任何一个规则出错都不会添加
 func (rg *RuleGroup) AppendBytes(bytes []byte) error {
   if len(bytes) == 0 {
     return base.ErrInvalidArgument
   }
-  r := &Rule{}
-  e := yaml.Unmarshal(bytes, r)
+  rules, e := parseRules(bytes)
   if e != nil {
     return e
   }
-  if r.Group != rg.name {
-    return ErrDifferentRuleGroup
+  for _, r := range rules {
+    if r.Group != rg.name {
+      return ErrDifferentRuleGroup
+    }
+  }
+  for _, r := range rules {
+    rg.append(r)
   }
-  r.init()
+  return nil
+}
+
+// 同一个Id的规则，版本号不小于已有规则时才会替换，
+// 返回是否添加（或替换）了规则
+func (rg *RuleGroup) append(r *Rule) bool {
   rg.mu.Lock()
   defer rg.mu.Unlock()
+  if !rg.put(r) {
+    return false
+  }
+  rg.sort()
+  return true
+}
+
+// 同append，但不加锁也不排序
+func (rg *RuleGroup) put(r *Rule) bool {
   found := -1
   for i, old := range rg.rules {
     if old.Id == r.Id {
@@ -68,14 +134,18 @@ func (rg *RuleGroup) AppendBytes(bytes []byte) error {
   if found == -1 {
     rg.rules = append(rg.rules, r)
   } else {
-    if rg.rules[found].Version <= r.Version {
-      rg.rules[found] = r
+    if rg.rules[found].Version > r.Version {
+      return false
     }
+    rg.rules[found] = r
   }
+  return true
+}
+
+func (rg *RuleGroup) sort() {
   sort.SliceStable(rg.rules, func(i, j int) bool {
     return rg.rules[i].Priority < rg.rules[j].Priority
   })
-  return nil
 }
 
 func (rg *RuleGroup) AppendFile(file string) error {
@@ -95,13 +165,92 @@ func (rg *RuleGroup) Remove(id string) error {
   }
   rg.mu.Lock()
   defer rg.mu.Unlock()
+  rg.remove(id)
+  return nil
+}
+
+func (rg *RuleGroup) remove(id string) {
   for i, r := range rg.rules {
     if r.Id == id {
       rg.rules = append(rg.rules[:i], rg.rules[i+1:]...)
       break
     }
   }
-  return nil
+}
+
+// 解析并校验规则，校验失败返回*ValidationError
+func ParseRule(bytes []byte) (*Rule, error) {
+  if len(bytes) == 0 {
+    return nil, base.ErrInvalidArgument
+  }
+  doc := &yaml.Node{}
+  e := yaml.Unmarshal(bytes, doc)
+  if e != nil {
+    return nil, e
+  }
+  return parseRuleNode(doc)
+}
+
+// 解析多文档（---分隔）的YAML，返回解析成功的规则，
+// 所有出错文档的问题合并为一个*ValidationError（Problem.Document为文档的序号）
+func parseRules(data []byte) ([]*Rule, error) {
+  var rules []*Rule
+  var ids []string
+  var problems []*Problem
+  dec := yaml.NewDecoder(bytes.NewReader(data))
+  for i := 1; ; i++ {
+    doc := &yaml.Node{}
+    e := dec.Decode(doc)
+    if e == io.EOF {
+      break
+    }
+    if e != nil {
+      // 语法错误后无法继续解析后面的文档
+      problems = append(problems, &Problem{Document: i, Msg: e.Error()})
+      break
+    }
+    r, e := parseRuleNode(doc)
+    if e == ErrEmptyRule {
+      continue
+    }
+    if e == nil {
+      rules = append(rules, r)
+      continue
+    }
+    if ve, ok := e.(*ValidationError); ok {
+      if ve.Id != "" {
+        ids = append(ids, ve.Id)
+      }
+      for _, p := range ve.Problems {
+        p.Document = i
+        problems = append(problems, p)
+      }
+    } else {
+      problems = append(problems, &Problem{Document: i, Msg: e.Error()})
+    }
+  }
+  if len(problems) > 0 {
+    return rules, &ValidationError{Id: strings.Join(ids, ","), Problems: problems}
+  }
+  return rules, nil
+}
+
+func parseRuleNode(doc *yaml.Node) (*Rule, error) {
+  if doc.Kind == 0 || (doc.Kind == yaml.DocumentNode && len(doc.Content) == 0) {
+    return nil, ErrEmptyRule
+  }
+  r := &Rule{}
+  e := doc.Decode(r)
+  if e != nil {
+    return nil, e
+  }
+  r.node = doc
+  e = r.Validate()
+  if e != nil {
+    return nil, e
+  }
+  r.init()
+  return r, nil
 }
 
 type Rule struct {
@@ -116,10 +265,49 @@ type Rule struct {
   Prepare  *Prepare      `yaml:"prepare"`
   Timeout  string        `yaml:"timeout"`
   timeout  time.Duration `yaml:"-"`
-  Fields   []*Field      `yaml:"fields"`
-  Loop     *Loop         `yaml:"loop"`
+  Trigger  *Trigger      `yaml:"trigger"`
+
+  // 需要捕获的响应，由field或loop的response引用
+  Responses []*Response `yaml:"responses"`
+
+  // 需要拦截的请求
+  Block *Block `yaml:"block"`
+
+  // 退出登录时重新登录（需要Page.Session）
+  Login *Login `yaml:"login"`
+
+  // 导航之前设置，值中的${NAME}会被替换为环境变量
+  Headers   map[string]string `yaml:"headers"`
+  Cookies   []*Cookie         `yaml:"cookies"`
+  UserAgent string            `yaml:"user_agent"`
+
+  // 在独立的BrowserContext中打开Tab（不共享cookies、localStorage和缓存）
+  Isolated bool `yaml:"isolated"`
+
+  // 代理（如socks5://127.0.0.1:1080）或direct（不使用代理），
+  // 使用代理时会在独立的BrowserContext中打开Tab
+  Proxy string `yaml:"proxy"`
+
+  // 设备和环境模拟（视口、UA、时区、语言区域、地理位置等）
+  Emulation *Emulation `yaml:"emulation"`
+
+  // 截图、PDF或MHTML，结果通过CaptureHandler返回
+  Captures []*Capture `yaml:"capture"`
+
+  Fields []*Field `yaml:"fields"`
+  Loop   *Loop    `yaml:"loop"`
+  Retry  *Retry   `yaml:"retry"`
+
+  // 解析时的YAML节点，用于校验时定位问题
+  node *yaml.Node `yaml:"-"`
+
+  // 是否有network_idle条件（需要开启Network）
+  network bool `yaml:"-"`
 }
 
+// 校验通过后调用，解析时间、编译正则表达式、生成表达式等，
+// 之后Rule不会再被修改（多个Page可以并发使用同一个Rule），
+// 不要修改已加载的Rule，需要修改时应重新加载
 func (r *Rule) init() {
   r.patterns = make([]*Pattern, 0, len(r.Patterns))
   for _, p := range r.Patterns {
@@ -129,8 +317,16 @@ func (r *Rule) init() {
     }
     r.patterns = append(r.patterns, &Pattern{p, re})
   }
-  if r.Prepare != nil && r.Prepare.Wait != "" {
-    r.Prepare.wait, _ = time.ParseDuration(r.Prepare.Wait)
+  r.Prepare.init()
+  r.network = r.Prepare != nil && needNetwork(r.Prepare.WaitFor)
+  for _, resp := range r.Responses {
+    resp.init()
+  }
+  r.Block.init()
+  r.Login.init()
+  r.Emulation.init()
+  for _, c := range r.Captures {
+    c.init()
   }
   r.timeout = time.Second * 10
   if r.Timeout != "" {
@@ -140,18 +336,40 @@ func (r *Rule) init() {
     if f.Wait != "" {
       f.wait, _ = time.ParseDuration(f.Wait)
     }
+    f.query = compileSelector(f)
+    if f.query != "" && f.All && f.Type == "" {
+      f.Type = TypeArray
+    }
+    switch {
+    case f.query != "":
+      f.expr = f.query
+    case f.Eval != "" && f.Value != "":
+      f.expr = fieldValueExpr(f.Value, f.Eval)
+    default:
+      f.expr = blockExpr(f.Eval)
+    }
+    f.transforms, _ = compileTransforms(f.Transforms)
+    initWaitFor(f.WaitFor)
+    r.network = r.network || needNetwork(f.WaitFor)
   }
   if r.Loop != nil {
     if r.Loop.ExportCycle == 0 {
       r.Loop.ExportCycle = 10
     }
-    if r.Loop.Prepare != nil && r.Loop.Prepare.Wait != "" {
-      r.Loop.Prepare.wait, _ = time.ParseDuration(r.Loop.Prepare.Wait)
-    }
+    r.Loop.Prepare.init()
+    r.Loop.eval = blockExpr(r.Loop.Eval)
+    r.Loop.next = blockExpr(r.Loop.Next)
     if r.Loop.Wait != "" {
       r.Loop.wait, _ = time.ParseDuration(r.Loop.Wait)
     }
+    r.Loop.transforms, _ = compileTransforms(r.Loop.Transforms)
+    initWaitFor(r.Loop.WaitFor)
+    r.network = r.network || needNetwork(r.Loop.WaitFor)
+    if r.Loop.Prepare != nil {
+      r.network = r.network || needNetwork(r.Loop.Prepare.WaitFor)
+    }
   }
+  r.Retry.init()
 }
 
 type Pattern struct {
@@ -160,28 +378,144 @@ type Pattern struct {
 }
 
 type Prepare struct {
-  Eval string        `yaml:"eval"`
-  Wait string        `yaml:"wait"`
-  wait time.Duration `yaml:"-"`
+  Eval    string        `yaml:"eval"`
+  expr    string        `yaml:"-"`
+  Wait    string        `yaml:"wait"`
+  wait    time.Duration `yaml:"-"`
+  WaitFor []*WaitFor    `yaml:"wait_for"`
+}
+
+func (p *Prepare) init() {
+  if p == nil {
+    return
+  }
+  p.expr = blockExpr(p.Eval)
+  if p.Wait != "" {
+    p.wait, _ = time.ParseDuration(p.Wait)
+  }
+  initWaitFor(p.WaitFor)
+}
+
+func (p *Prepare) validate(v *validator, path ...interface{}) {
+  if p == nil {
+    return
+  }
+  v.duration(p.Wait, sub(path, "wait")...)
+  v.waitFor(p.WaitFor, sub(path, "wait_for")...)
 }
 
 type Field struct {
-  Name   string        `yaml:"name"`
-  Alias  string        `yaml:"alias"`
-  Value  string        `yaml:"value"`
-  Eval   string        `yaml:"eval"`
-  Export bool          `yaml:"export"`
-  Wait   string        `yaml:"wait"`
-  wait   time.Duration `yaml:"-"`
+  Name  string `yaml:"name"`
+  Alias string `yaml:"alias"`
+  Value string `yaml:"value"`
+  Eval  string `yaml:"eval"`
+
+  // 用CSS选择器或XPath代替eval，由collector生成表达式，
+  // attr表示取属性值，否则按mode（text（默认）、html、ownText）取内容，
+  // all为true时返回所有匹配元素的数组（type默认为array）
+  Selector string `yaml:"selector"`
+  Xpath    string `yaml:"xpath"`
+  Attr     string `yaml:"attr"`
+  Mode     string `yaml:"mode"`
+  All      bool   `yaml:"all"`
+  query    string `yaml:"-"`
+
+  // 最终执行的表达式（由eval、value或selector/xpath生成）
+  expr string `yaml:"-"`
+
+  // 使用捕获到的响应（responses的name）代替eval，
+  // all为true时返回所有捕获到的响应（数组），否则为最后一个
+  Response string `yaml:"response"`
+
+  Type string `yaml:"type"`
+
+  // eval（或value）结果的处理，在Go中按顺序执行
+  Transforms []*Transform    `yaml:"transforms"`
+  transforms []TransformFunc `yaml:"-"`
+
+  Export  bool          `yaml:"export"`
+  Wait    string        `yaml:"wait"`
+  wait    time.Duration `yaml:"-"`
+  WaitFor []*WaitFor    `yaml:"wait_for"`
+}
+
+// name是否重复由Rule.Validate检查，responses为responses中name对应的下标
+func (f *Field) validate(v *validator, responses map[string]int, path ...interface{}) {
+  if f.Name == "" {
+    v.add("name is required", sub(path, "name")...)
+  } else if !fieldNameRegexp.MatchString(f.Name) {
+    v.add(fmt.Sprintf("invalid name %q (only letters, digits, _ and $ are allowed)", f.Name), sub(path, "name")...)
+  }
+  if f.Selector != "" && f.Xpath != "" {
+    v.add("selector and xpath are exclusive", sub(path, "xpath")...)
+  }
+  if (f.Selector != "" || f.Xpath != "") && f.Eval != "" {
+    v.add("eval can not be used with selector or xpath", sub(path, "eval")...)
+  }
+  if f.Response != "" {
+    if f.Selector != "" || f.Xpath != "" || f.Eval != "" || f.Value != "" {
+      v.add("response can not be used with eval, value, selector or xpath", sub(path, "response")...)
+    } else if _, ok := responses[f.Response]; !ok {
+      v.add(fmt.Sprintf("response %q not found", f.Response), sub(path, "response")...)
+    }
+  }
+  if f.Selector == "" && f.Xpath == "" && (f.Attr != "" || f.Mode != "" || (f.All && f.Response == "")) {
+    v.add("attr, mode and all require selector or xpath", path...)
+  }
+  if f.Eval == "" && f.Value == "" && f.Selector == "" && f.Xpath == "" && f.Response == "" {
+    v.add("one of eval, value, selector, xpath or response is required", path...)
+  }
+  switch f.Mode {
+  case "", ModeText, ModeHtml, ModeOwnText:
+  default:
+    v.add(fmt.Sprintf("unknown mode %q", f.Mode), sub(path, "mode")...)
+  }
+  v.typ(f.Type, sub(path, "type")...)
+  v.transforms(f.Transforms, sub(path, "transforms")...)
+  v.duration(f.Wait, sub(path, "wait")...)
+  v.waitFor(f.WaitFor, sub(path, "wait_for")...)
 }
 
 type Loop struct {
-  Name        string        `yaml:"name"`
-  Alias       string        `yaml:"alias"`
-  ExportCycle int           `yaml:"export_cycle"`
-  Prepare     *Prepare      `yaml:"prepare"`
-  Eval        string        `yaml:"eval"`
-  Next        string        `yaml:"next"`
-  Wait        string        `yaml:"wait"`
-  wait        time.Duration `yaml:"-"`
+  Name        string          `yaml:"name"`
+  Alias       string          `yaml:"alias"`
+  ExportCycle int             `yaml:"export_cycle"`
+  Type        string          `yaml:"type"`
+  Transforms  []*Transform    `yaml:"transforms"`
+  transforms  []TransformFunc `yaml:"-"`
+  Prepare     *Prepare        `yaml:"prepare"`
+  Eval        string          `yaml:"eval"`
+  eval        string          `yaml:"-"`
+  Response    string          `yaml:"response"`
+  All         bool            `yaml:"all"`
+  Next        string          `yaml:"next"`
+  next        string          `yaml:"-"`
+  Wait        string          `yaml:"wait"`
+  wait        time.Duration   `yaml:"-"`
+  WaitFor     []*WaitFor      `yaml:"wait_for"`
+}
+
+func (l *Loop) validate(v *validator, responses map[string]int, path ...interface{}) {
+  if l == nil {
+    return
+  }
+  if l.Eval == "" && l.Response == "" {
+    v.add("loop without eval or response", path...)
+  }
+  if l.Eval != "" && l.Response != "" {
+    v.add("eval and response are exclusive", sub(path, "response")...)
+  } else if _, ok := responses[l.Response]; l.Response != "" && !ok {
+    v.add(fmt.Sprintf("response %q not found", l.Response), sub(path, "response")...)
+  }
+  if l.All && l.Response == "" {
+    v.add("all can only be used with response", sub(path, "all")...)
+  }
+  if l.ExportCycle < 0 {
+    v.add("export_cycle must not be negative", sub(path, "export_cycle")...)
+  }
+  v.typ(l.Type, sub(path, "type")...)
+  v.transforms(l.Transforms, sub(path, "transforms")...)
+  l.Prepare.validate(v, sub(path, "prepare")...)
+  v.duration(l.Wait, sub(path, "wait")...)
+  v.waitFor(l.WaitFor, sub(path, "wait_for")...)
 }
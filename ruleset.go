@@ -0,0 +1,214 @@
+package collector
+
+import (
+  "fmt"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "sort"
+  "strings"
+  "sync"
+
+  "github.com/kwf2030/commons/base"
+)
+
+// 加载多个文件时的错误，key是文件路径，
+// 规则的问题是*ValidationError（多文档YAML中所有出错文档的问题合并在一起）
+type LoadError struct {
+  Files map[string][]error
+}
+
+func (e *LoadError) Error() string {
+  files := make([]string, 0, len(e.Files))
+  for f := range e.Files {
+    files = append(files, f)
+  }
+  sort.Strings(files)
+  arr := make([]string, 0, len(files))
+  for _, f := range files {
+    for _, fe := range e.Files[f] {
+      arr = append(arr, f+": "+fe.Error())
+    }
+  }
+  return strings.Join(arr, "\n")
+}
+
+func (e *LoadError) add(file string, errs ...error) {
+  if e.Files == nil {
+    e.Files = make(map[string][]error, 4)
+  }
+  e.Files[file] = append(e.Files[file], errs...)
+}
+
+// 按分组管理规则，规则会根据group自动添加到对应的RuleGroup
+type RuleSet struct {
+  groups map[string]*RuleGroup
+  mu     sync.RWMutex
+}
+
+func NewRuleSet() *RuleSet {
+  return &RuleSet{groups: make(map[string]*RuleGroup, 8), mu: sync.RWMutex{}}
+}
+
+// 返回分组，没有该分组返回nil
+func (rs *RuleSet) Group(name string) *RuleGroup {
+  rs.mu.RLock()
+  defer rs.mu.RUnlock()
+  return rs.groups[name]
+}
+
+// 返回所有分组名（已排序）
+func (rs *RuleSet) Groups() []string {
+  rs.mu.RLock()
+  defer rs.mu.RUnlock()
+  ret := make([]string, 0, len(rs.groups))
+  for name := range rs.groups {
+    ret = append(ret, name)
+  }
+  sort.Strings(ret)
+  return ret
+}
+
+func (rs *RuleSet) group(name string) *RuleGroup {
+  rs.mu.Lock()
+  defer rs.mu.Unlock()
+  rg, ok := rs.groups[name]
+  if !ok {
+    rg = NewRuleGroup(name)
+    rs.groups[name] = rg
+  }
+  return rg
+}
+
+// 添加（或替换）rules并移除removed（group-->ids）中的规则，
+// 所有涉及的分组同时加锁，采集中的Page不会匹配到只应用了一部分的规则，
+// 返回因版本号低于已有规则而被拒绝的规则
+func (rs *RuleSet) update(rules []*Rule, removed map[string][]string) []*Rule {
+  rs.mu.Lock()
+  defer rs.mu.Unlock()
+  groups := make(map[string]*RuleGroup, 4)
+  for _, r := range rules {
+    rg, ok := rs.groups[r.Group]
+    if !ok {
+      rg = NewRuleGroup(r.Group)
+      rs.groups[r.Group] = rg
+    }
+    groups[r.Group] = rg
+  }
+  for name := range removed {
+    if rg, ok := rs.groups[name]; ok {
+      groups[name] = rg
+    }
+  }
+  // 按名称顺序加锁
+  names := make([]string, 0, len(groups))
+  for name := range groups {
+    names = append(names, name)
+  }
+  sort.Strings(names)
+  for _, name := range names {
+    groups[name].mu.Lock()
+  }
+  var rejected []*Rule
+  for name, ids := range removed {
+    if rg, ok := groups[name]; ok {
+      for _, id := range ids {
+        rg.remove(id)
+      }
+    }
+  }
+  for _, r := range rules {
+    if !groups[r.Group].put(r) {
+      rejected = append(rejected, r)
+    }
+  }
+  for _, name := range names {
+    groups[name].sort()
+    groups[name].mu.Unlock()
+  }
+  return rejected
+}
+
+// 支持多文档（---分隔）的YAML，出错的文档会被跳过，其它文档仍会添加，
+// 返回的错误是*LoadError（key为空字符串）
+func (rs *RuleSet) AppendBytes(bytes []byte) error {
+  if len(bytes) == 0 {
+    return base.ErrInvalidArgument
+  }
+  return rs.append("", bytes)
+}
+
+// 返回的错误是*LoadError（key为文件路径）
+func (rs *RuleSet) AppendFile(file string) error {
+  if file == "" {
+    return base.ErrInvalidArgument
+  }
+  data, e := ioutil.ReadFile(file)
+  if e != nil {
+    return &LoadError{Files: map[string][]error{file: {e}}}
+  }
+  return rs.append(file, data)
+}
+
+func (rs *RuleSet) append(file string, data []byte) error {
+  rules, e := parseRules(data)
+  for _, r := range rules {
+    rs.group(r.Group).append(r)
+  }
+  if e != nil {
+    return &LoadError{Files: map[string][]error{file: {e}}}
+  }
+  return nil
+}
+
+// 加载目录（包括子目录）下所有的.yml和.yaml文件（忽略以.开头的文件和目录），
+// 出错的文件不会中断加载，所有错误通过*LoadError返回
+func (rs *RuleSet) AppendDir(dir string) error {
+  if dir == "" {
+    return base.ErrInvalidArgument
+  }
+  files, e := ruleFiles(dir)
+  if e != nil {
+    return e
+  }
+  le := &LoadError{}
+  for _, f := range files {
+    if e := rs.AppendFile(f); e != nil {
+      le.add(f, e.(*LoadError).Files[f]...)
+    }
+  }
+  if len(le.Files) > 0 {
+    return le
+  }
+  return nil
+}
+
+// 返回目录下所有的规则文件（已排序）
+func ruleFiles(dir string) ([]string, error) {
+  var files []string
+  e := filepath.Walk(dir, func(path string, info os.FileInfo, e error) error {
+    if e != nil {
+      return e
+    }
+    name := info.Name()
+    if path != dir && strings.HasPrefix(name, ".") {
+      if info.IsDir() {
+        return filepath.SkipDir
+      }
+      return nil
+    }
+    if info.IsDir() {
+      return nil
+    }
+    switch strings.ToLower(filepath.Ext(name)) {
+    case ".yml", ".yaml":
+      files = append(files, path)
+    }
+    return nil
+  })
+  if e != nil {
+    return nil, fmt.Errorf("walk %s: %w", dir, e)
+  }
+  sort.Strings(files)
+  return files, nil
+}
@@ -0,0 +1,84 @@
+package collector
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func writeFile(t *testing.T, dir, name, content string) string {
+  t.Helper()
+  path := filepath.Join(dir, name)
+  if e := os.MkdirAll(filepath.Dir(path), 0755); e != nil {
+    t.Fatal(e)
+  }
+  if e := ioutil.WriteFile(path, []byte(content), 0644); e != nil {
+    t.Fatal(e)
+  }
+  return path
+}
+
+func TestRuleSetAppendDir(t *testing.T) {
+  dir, e := ioutil.TempDir("", "ruleset")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+
+  writeFile(t, dir, "a.yml", `id: "1"
+group: "g1"
+patterns: ["a.com"]
+fields:
+  - name: "x"
+    eval: "1"
+---
+id: "2"
+group: "g2"
+patterns: ["b.com"]
+fields:
+  - name: "x"
+    eval: "1"
+`)
+  bad := writeFile(t, dir, "sub/b.yaml", `id: "3"
+group: "g1"
+patterns: ["c.com"]
+fields:
+  - name: "x"
+    eval: "1"
+---
+id: "4"
+group: "g2"
+patterns: []
+`)
+  broken := writeFile(t, dir, "broken.yml", "id: [")
+  writeFile(t, dir, ".hidden/c.yml", "id: [")
+  writeFile(t, dir, "readme.txt", "id: [")
+
+  rs := NewRuleSet()
+  e = rs.AppendDir(dir)
+  le, ok := e.(*LoadError)
+  if !ok {
+    t.Fatalf("want *LoadError, got %v", e)
+  }
+  if len(le.Files) != 2 || len(le.Files[bad]) != 1 || len(le.Files[broken]) != 1 {
+    t.Fatalf("unexpected errors: %v", le)
+  }
+  if !strings.Contains(le.Files[bad][0].Error(), "document 2") {
+    t.Fatalf("unexpected error: %v", le.Files[bad][0])
+  }
+
+  if groups := rs.Groups(); len(groups) != 2 || groups[0] != "g1" || groups[1] != "g2" {
+    t.Fatalf("unexpected groups %v", groups)
+  }
+  if r := rs.Group("g1").match("http://c.com"); r == nil || r.Id != "3" {
+    t.Fatalf("rule 3 not loaded")
+  }
+  if r := rs.Group("g2").match("http://b.com"); r == nil || r.Id != "2" {
+    t.Fatalf("rule 2 not loaded")
+  }
+  if rs.Group("g3") != nil {
+    t.Fatal("want nil group")
+  }
+}
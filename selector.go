@@ -0,0 +1,69 @@
+package collector
+
+import (
+  "fmt"
+)
+
+const (
+  ModeText    = "text"
+  ModeHtml    = "html"
+  ModeOwnText = "ownText"
+)
+
+// 选择器没有匹配到元素时，表达式返回的对象带有该属性
+const selectorNotFound = "cdp_selector_not_found"
+
+// selector/xpath没有匹配到元素（all为true时不会出现该错误，而是返回空数组）
+type SelectorError struct {
+  Selector string
+}
+
+func (e *SelectorError) Error() string {
+  return fmt.Sprintf("selector not found: %s", e.Selector)
+}
+
+// 检查是否是选择器没有匹配到元素时的返回值
+func isSelectorNotFound(v interface{}) bool {
+  m, ok := v.(map[string]interface{})
+  if !ok {
+    return false
+  }
+  _, ok = m[selectorNotFound]
+  return ok
+}
+
+// 把field的selector/xpath/attr/all/mode编译为表达式，
+// 没有selector和xpath时返回空字符串
+func compileSelector(f *Field) string {
+  query := queryNodes(f.Selector, f.Xpath)
+  if query == "" {
+    return ""
+  }
+  var extract string
+  switch {
+  case f.Attr != "":
+    extract = "n=>n.getAttribute?(n.getAttribute(" + jsString(f.Attr) + ")||''):''"
+  case f.Mode == ModeHtml:
+    extract = "n=>n.innerHTML!==undefined?n.innerHTML:n.textContent"
+  case f.Mode == ModeOwnText:
+    extract = "n=>Array.prototype.slice.call(n.childNodes).filter(c=>c.nodeType===Node.TEXT_NODE).map(c=>c.textContent).join('').trim()"
+  default:
+    extract = "n=>n.textContent.trim()"
+  }
+  if f.All {
+    return "{" + query + ".map(" + extract + ");}"
+  }
+  return "{let cdp_nodes=" + query + ";cdp_nodes.length===0?{" + selectorNotFound + ":true}:(" + extract + ")(cdp_nodes[0]);}"
+}
+
+// selector或xpath匹配的所有节点（数组）的表达式，都为空时返回空字符串
+func queryNodes(selector, xpath string) string {
+  switch {
+  case selector != "":
+    return "Array.prototype.slice.call(document.querySelectorAll(" + jsString(selector) + "))"
+  case xpath != "":
+    return "(function(){let r=document.evaluate(" + jsString(xpath) + ",document,null,XPathResult.ORDERED_NODE_SNAPSHOT_TYPE,null);" +
+      "let a=[];for(let i=0;i<r.snapshotLength;i++){a.push(r.snapshotItem(i));}return a;})()"
+  }
+  return ""
+}
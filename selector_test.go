@@ -0,0 +1,44 @@
+package collector
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestCompileSelector(t *testing.T) {
+  if s := compileSelector(&Field{Eval: "1"}); s != "" {
+    t.Fatalf("want empty, got %q", s)
+  }
+
+  s := compileSelector(&Field{Selector: `a[title="it's"]`})
+  if !strings.Contains(s, `document.querySelectorAll("a[title=\"it's\"]")`) {
+    t.Fatalf("selector not quoted: %s", s)
+  }
+  if !strings.Contains(s, selectorNotFound) || !strings.Contains(s, "textContent.trim()") {
+    t.Fatalf("unexpected %s", s)
+  }
+
+  s = compileSelector(&Field{Xpath: "//a", Attr: "href", All: true})
+  if !strings.Contains(s, `document.evaluate("//a"`) || !strings.Contains(s, `getAttribute("href")`) || !strings.Contains(s, ".map(") {
+    t.Fatalf("unexpected %s", s)
+  }
+  if strings.Contains(s, selectorNotFound) {
+    t.Fatalf("all should not report not found: %s", s)
+  }
+
+  if s = compileSelector(&Field{Selector: "p", Mode: ModeHtml}); !strings.Contains(s, "innerHTML") {
+    t.Fatalf("unexpected %s", s)
+  }
+  if s = compileSelector(&Field{Selector: "p", Mode: ModeOwnText}); !strings.Contains(s, "TEXT_NODE") {
+    t.Fatalf("unexpected %s", s)
+  }
+}
+
+func TestIsSelectorNotFound(t *testing.T) {
+  if !isSelectorNotFound(map[string]interface{}{selectorNotFound: true}) {
+    t.Fatal("want true")
+  }
+  if isSelectorNotFound("x") || isSelectorNotFound(map[string]interface{}{"a": 1}) {
+    t.Fatal("want false")
+  }
+}
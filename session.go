@@ -0,0 +1,306 @@
+package collector
+
+import (
+  "encoding/json"
+  "errors"
+  "fmt"
+  "io/ioutil"
+  "os"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/base"
+  "github.com/kwf2030/commons/conv"
+)
+
+const (
+  networkGetAllCookies                 = "Network.getAllCookies"
+  pageAddScriptToEvaluateOnNewDocument = "Page.addScriptToEvaluateOnNewDocument"
+)
+
+var (
+  ErrLoginFailed = errors.New("login failed")
+  ErrLoggedOut   = errors.New("still logged out after login")
+)
+
+// 重新登录
+type Login struct {
+  // 登录页面的URL，由同一个分组中匹配的规则完成登录（如填写表单并提交）
+  Url string `yaml:"url"`
+
+  // 页面加载后执行，为真（truthy）表示已退出登录，需要重新登录
+  Check string `yaml:"check"`
+  check string `yaml:"-"`
+}
+
+func (l *Login) init() {
+  if l == nil {
+    return
+  }
+  // 直接执行（页面的CSP可能不允许eval），真值在Go中判断
+  l.check = blockExpr(l.Check)
+}
+
+func (l *Login) validate(v *validator, path ...interface{}) {
+  if l == nil {
+    return
+  }
+  if l.Url == "" {
+    v.add("url is required", sub(path, "url")...)
+  }
+  if l.Check == "" {
+    v.add("check is required", sub(path, "check")...)
+  }
+}
+
+// setCookies可以使用的cookie属性（getAllCookies返回的其它属性会被忽略）
+var cookieKeys = []string{"name", "value", "domain", "path", "secure", "httpOnly", "sameSite", "expires"}
+
+// 登录状态（cookies和localStorage），可以被多个Page共用，
+// 由登录规则采集后更新，可以保存到文件
+type Session struct {
+  name string
+  file string
+
+  cookies []map[string]interface{}
+
+  // origin对应的localStorage
+  storage map[string]map[string]string
+
+  updated time.Time
+  mu      sync.RWMutex
+
+  // 同一时间只能有一个Page重新登录
+  login sync.Mutex
+}
+
+// 保存到文件的格式
+type sessionData struct {
+  Name    string                       `json:"name"`
+  Cookies []map[string]interface{}     `json:"cookies"`
+  Storage map[string]map[string]string `json:"storage"`
+  Updated time.Time                    `json:"updated"`
+}
+
+func NewSession(name string) *Session {
+  if name == "" {
+    return nil
+  }
+  return &Session{name: name, storage: make(map[string]map[string]string, 4)}
+}
+
+// 从文件加载（文件不存在时为空的Session），重新登录后会自动保存到该文件
+func OpenSession(name, file string) (*Session, error) {
+  if name == "" || file == "" {
+    return nil, base.ErrInvalidArgument
+  }
+  s := NewSession(name)
+  s.file = file
+  data, e := ioutil.ReadFile(file)
+  if os.IsNotExist(e) {
+    return s, nil
+  }
+  if e != nil {
+    return nil, e
+  }
+  d := &sessionData{}
+  if e = json.Unmarshal(data, d); e != nil {
+    return nil, e
+  }
+  s.cookies, s.updated = d.Cookies, d.Updated
+  if d.Storage != nil {
+    s.storage = d.Storage
+  }
+  return s, nil
+}
+
+func (s *Session) Name() string {
+  return s.name
+}
+
+// 最后一次登录的时间
+func (s *Session) Updated() time.Time {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  return s.updated
+}
+
+func (s *Session) Save(file string) error {
+  if file == "" {
+    return base.ErrInvalidArgument
+  }
+  s.mu.RLock()
+  data, e := json.MarshalIndent(&sessionData{Name: s.name, Cookies: s.cookies, Storage: s.storage, Updated: s.updated}, "", "  ")
+  s.mu.RUnlock()
+  if e != nil {
+    return e
+  }
+  // 先写临时文件再重命名，避免写到一半时中断
+  tmp := file + ".tmp"
+  if e = ioutil.WriteFile(tmp, data, 0600); e != nil {
+    return e
+  }
+  return os.Rename(tmp, file)
+}
+
+// 清除登录状态（下次检查到退出登录时会重新登录）
+func (s *Session) Clear() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.cookies = nil
+  s.storage = make(map[string]map[string]string, 4)
+  s.updated = time.Time{}
+}
+
+// 恢复cookies和localStorage（在导航之前调用）
+func (s *Session) apply(tab cdpTab) {
+  s.mu.RLock()
+  defer s.mu.RUnlock()
+  if len(s.cookies) > 0 {
+    tab.Call(cdp.Network.Enable, nil)
+    tab.Call(networkSetCookies, map[string]interface{}{"cookies": s.cookies})
+  }
+  for origin, items := range s.storage {
+    if len(items) == 0 {
+      continue
+    }
+    src := "if(location.origin===" + jsString(origin) + "){let items=" + jsLiteral(items) +
+      ";for(let k in items){try{localStorage.setItem(k,items[k]);}catch(e){}}}"
+    tab.Call(pageAddScriptToEvaluateOnNewDocument, map[string]interface{}{"source": src})
+  }
+}
+
+// 从登录页面的Tab获取cookies和localStorage
+func (s *Session) capture(p *Page) error {
+  msg, e := p.call(networkGetAllCookies, nil)
+  if e != nil {
+    return e
+  }
+  var cookies []map[string]interface{}
+  if arr, ok := msg.Result["cookies"].([]interface{}); ok {
+    for _, v := range arr {
+      c, ok := v.(map[string]interface{})
+      if !ok {
+        continue
+      }
+      m := make(map[string]interface{}, len(cookieKeys))
+      for _, k := range cookieKeys {
+        if v, ok := c[k]; ok {
+          m[k] = v
+        }
+      }
+      // 会话cookie的expires为-1
+      if conv.Int64(m["expires"], 0) <= 0 {
+        delete(m, "expires")
+      }
+      cookies = append(cookies, m)
+    }
+  }
+  msg, e = p.eval(map[string]interface{}{
+    "expression":    "({origin:location.origin,items:Object.assign({},localStorage)})",
+    "returnByValue": true,
+  })
+  if e != nil {
+    return e
+  }
+  v, _ := resultValue(msg).(map[string]interface{})
+  origin := conv.GetString(v, "origin", "")
+  items := make(map[string]string, 16)
+  for k, v := range conv.GetMap(v, "items") {
+    items[k] = conv.String(v, "")
+  }
+  s.mu.Lock()
+  s.cookies = cookies
+  if origin != "" && origin != "null" {
+    s.storage[origin] = items
+  }
+  s.updated = time.Now()
+  s.mu.Unlock()
+  if s.file != "" {
+    return s.Save(s.file)
+  }
+  return nil
+}
+
+// 重新登录，如果在since之后已经被其它Page更新过，直接返回
+func (s *Session) refresh(p *Page, since time.Time) error {
+  s.login.Lock()
+  defer s.login.Unlock()
+  if s.Updated().After(since) {
+    return nil
+  }
+  lp := NewPage(p.Rule.Login.Url, p.Group)
+  lp.Headers, lp.Cookies, lp.UserAgent = p.Headers, p.Cookies, p.UserAgent
+  lp.newContext = p.newContext
+  h := &loginHandler{s: s, done: make(chan struct{})}
+  if e := lp.collect(p.ctx, p.newTab, p.rg, h); e != nil {
+    return e
+  }
+  <-h.done
+  if e := lp.Err(); e != nil {
+    return e
+  }
+  return h.err
+}
+
+// 登录页面采集完成后更新Session
+type loginHandler struct {
+  s    *Session
+  err  error
+  done chan struct{}
+}
+
+func (h *loginHandler) OnFields(p *Page, data Record) {
+}
+
+func (h *loginHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  return true
+}
+
+func (h *loginHandler) OnComplete(p *Page) {
+  defer close(h.done)
+  defer p.Close()
+  if p.Err() == nil {
+    h.err = h.s.capture(p)
+  }
+}
+
+// 检查是否已退出登录，是则关闭当前Tab，重新登录后在新的Tab中重新采集，
+// 返回是否需要重新采集
+func (p *Page) checkLogin(a *attempt) bool {
+  l, s := p.Rule.Login, p.Session
+  if l == nil || s == nil || p.ctx.Err() != nil {
+    return false
+  }
+  msg, e := p.eval(map[string]interface{}{"expression": l.check, "returnByValue": true})
+  if e != nil {
+    p.report(StageLogin, "", e)
+    return false
+  }
+  if !truthy(resultValue(msg)) {
+    return false
+  }
+  if p.relogin {
+    p.report(StageLogin, "", ErrLoggedOut)
+    return false
+  }
+  p.relogin = true
+  timers.stop(a.timeout)
+  a.tab.Close()
+  go func() {
+    e := s.refresh(p, a.started)
+    if e == nil {
+      // 不算作重试
+      if e = p.start(a.n); e == nil {
+        return
+      }
+    } else if p.ctx.Err() == nil {
+      p.report(StageLogin, "", e)
+      e = fmt.Errorf("%w: %v", ErrLoginFailed, e)
+    }
+    p.setErr(e)
+    p.finish()
+  }()
+  return true
+}
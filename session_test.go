@@ -0,0 +1,124 @@
+package collector
+
+import (
+  "context"
+  "errors"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strings"
+  "sync"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+var sessionRules = `id: "data"
+group: "g"
+patterns: ["example.com/data"]
+login:
+  url: "http://example.com/login"
+  check: "document.querySelector('.login')"
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+---
+id: "login"
+group: "g"
+patterns: ["example.com/login"]
+fields:
+  - name: "submit"
+    eval: "document.forms[0].submit()"
+`
+
+func TestSession(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(sessionRules)); e != nil {
+    t.Fatal(e)
+  }
+  dir, e := ioutil.TempDir("", "session")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  file := filepath.Join(dir, "s.json")
+  s, e := OpenSession("s", file)
+  if e != nil {
+    t.Fatal(e)
+  }
+
+  var mu sync.Mutex
+  var tabs []*fakeTab
+  newTab := func(h cdp.Handler) (cdpTab, error) {
+    mu.Lock()
+    defer mu.Unlock()
+    // 第1个Tab是退出登录状态，第2个是登录页面，第3个是登录后
+    loggedIn := len(tabs) > 0
+    tab := newFakeTab(h, func(expr string) interface{} {
+      switch {
+      case strings.Contains(expr, ".login"):
+        // 直接执行（不通过eval），按真值判断（元素按值返回为{}，不存在为null）
+        if strings.Contains(expr, "eval(") {
+          return errors.New("EvalError: Refused to evaluate a string as JavaScript")
+        }
+        if loggedIn {
+          return nil
+        }
+        return map[string]interface{}{}
+      case strings.Contains(expr, "localStorage"):
+        return map[string]interface{}{"origin": "http://example.com", "items": map[string]interface{}{"token": "t"}}
+      }
+      return "ok"
+    })
+    tab.cookies = []interface{}{
+      map[string]interface{}{"name": "sid", "value": "1", "domain": "example.com", "path": "/", "expires": -1.0, "size": 4.0},
+    }
+    tabs = append(tabs, tab)
+    return tab, nil
+  }
+  p := NewPage("http://example.com/data", "g")
+  p.Session = s
+  h := &errHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  if e := p.collect(context.Background(), newTab, rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if p.Err() != nil || len(h.errs) != 0 {
+    t.Fatal(p.Err(), h.errs)
+  }
+  mu.Lock()
+  defer mu.Unlock()
+  if len(tabs) != 3 || h.record["a"] != "ok" || h.fields != 1 {
+    t.Fatalf("want 3 tabs and a=ok, got %d tabs, %v", len(tabs), h.record)
+  }
+  if s.Updated().IsZero() {
+    t.Fatal("session not updated")
+  }
+  cookies := tabs[2].Calls(networkSetCookies)
+  if len(cookies) != 1 {
+    t.Fatalf("want cookies restored, got %d calls", len(cookies))
+  }
+  c := cookies[0].Params["cookies"].([]map[string]interface{})[0]
+  if c["name"] != "sid" || c["size"] != nil || c["expires"] != nil {
+    t.Fatalf("unexpected cookie %v", c)
+  }
+  scripts := tabs[2].Calls(pageAddScriptToEvaluateOnNewDocument)
+  if len(scripts) != 1 || !strings.Contains(scripts[0].Params["source"].(string), `{"token":"t"}`) {
+    t.Fatalf("want localStorage restored, got %v", scripts)
+  }
+
+  // 重新打开时从文件加载
+  s2, e := OpenSession("s", file)
+  if e != nil {
+    t.Fatal(e)
+  }
+  if !s2.Updated().Equal(s.Updated()) || len(s2.cookies) != 1 || s2.storage["http://example.com"]["token"] != "t" {
+    t.Fatalf("unexpected session loaded %+v", s2)
+  }
+}
@@ -1,7 +1,6 @@
 package collector
 
 import (
-  "encoding/json"
   "fmt"
   "runtime"
   "sync"
@@ -52,27 +51,24 @@ fields:
 loop:
   name: "002024"
   export_cycle: 1
-  eval: "let ret={};ret['price']=document.querySelectorAll('.col-1')[1].children[1].children[0].textContent.trim();ret['rising_falling']=document.querySelectorAll('.col-1')[1].children[1].children[1].children[0].textContent.trim();ret['max_price']=document.querySelectorAll('.col-2')[0].children[0].children[2].lastElementChild.textContent.trim();ret['min_price']=document.querySelectorAll('.col-2')[0].children[0].children[3].lastElementChild.textContent.trim();ret['amplitude']=document.querySelectorAll('.col-2')[0].children[2].children[2].lastElementChild.textContent.trim();ret['turnover']=document.querySelectorAll('.col-2')[0].children[2].children[0].lastElementChild.textContent.trim();ret['volumes1']=document.querySelectorAll('.col-2')[0].children[1].children[0].lastElementChild.textContent.trim();ret['volumes2']=document.querySelectorAll('.col-2')[0].children[1].children[1].lastElementChild.textContent.trim();ret['pe']=document.querySelectorAll('.col-2')[0].children[2].children[3].lastElementChild.textContent.trim();ret['pb']=document.querySelectorAll('.col-2')[0].children[2].children[1].lastElementChild.textContent.trim();JSON.stringify(ret);"
+  type: "object"
+  eval: "let ret={};ret['price']=document.querySelectorAll('.col-1')[1].children[1].children[0].textContent.trim();ret['rising_falling']=document.querySelectorAll('.col-1')[1].children[1].children[1].children[0].textContent.trim();ret['max_price']=document.querySelectorAll('.col-2')[0].children[0].children[2].lastElementChild.textContent.trim();ret['min_price']=document.querySelectorAll('.col-2')[0].children[0].children[3].lastElementChild.textContent.trim();ret['amplitude']=document.querySelectorAll('.col-2')[0].children[2].children[2].lastElementChild.textContent.trim();ret['turnover']=document.querySelectorAll('.col-2')[0].children[2].children[0].lastElementChild.textContent.trim();ret['volumes1']=document.querySelectorAll('.col-2')[0].children[1].children[0].lastElementChild.textContent.trim();ret['volumes2']=document.querySelectorAll('.col-2')[0].children[1].children[1].lastElementChild.textContent.trim();ret['pe']=document.querySelectorAll('.col-2')[0].children[2].children[3].lastElementChild.textContent.trim();ret['pb']=document.querySelectorAll('.col-2')[0].children[2].children[1].lastElementChild.textContent.trim();ret;"
   next: "cdp_loop_count<=10"
   wait: "1s"
 `)
 
 type Stock struct{}
 
-func (s *Stock) OnFields(p *Page, data map[string]string) {
+func (s *Stock) OnFields(p *Page, data Record) {
   fmt.Printf("%-10s%-9s%-6s%-7s%-8s%-8s\n", "代码", "名称", "总市值", "流通市值", "昨日收盘价", "今日开盘价")
   fmt.Printf("%-12s%-7s%-8s%-10s%-13s%-12s\n", data["code"], data["name"], data["total_market_value"], data["circulated_market_value"], data["closing_price"], data["opening_price"])
   fmt.Println()
   fmt.Printf("%-8s%-6s%-6s%-6s%-5s%-5s%-6s%-7s%-6s%-6s%-6s\n", "时间", "价格", "涨跌", "最高", "最低", "振幅", "换手率", "成交量", "成交额", "市盈率", "市净率")
 }
 
-func (s *Stock) OnLoop(p *Page, loopCount int, data []string) bool {
+func (s *Stock) OnLoop(p *Page, loopCount int, data []interface{}) bool {
   for _, v := range data {
-    m := make(map[string]string, 8)
-    e := json.Unmarshal([]byte(v), &m)
-    if e != nil {
-      panic(e)
-    }
+    m, _ := v.(map[string]interface{})
     fmt.Printf("%-10s%-8s%-8s%-8s%-7s%-7s%-9s%-8s%-8s%-9s%-8s\n", time.Now().Format("15:04:05"), m["price"], m["rising_falling"], m["max_price"], m["min_price"], m["amplitude"], m["turnover"], m["volumes1"], m["volumes2"], m["pe"], m["pb"])
   }
   return true
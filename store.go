@@ -0,0 +1,81 @@
+package collector
+
+import (
+  "encoding/json"
+  "time"
+
+  "github.com/kwf2030/commons/base"
+  bolt "go.etcd.io/bbolt"
+)
+
+var jobsBucket = []byte("jobs")
+
+// 持久化Crawler的任务，用于进程重启后恢复采集
+type Store interface {
+  // 保存任务（新增或更新）
+  Put(*Job) error
+
+  // 返回所有任务
+  Jobs() ([]*Job, error)
+
+  Close() error
+}
+
+// 基于bbolt的Store
+type BoltStore struct {
+  db *bolt.DB
+}
+
+func OpenBoltStore(path string) (*BoltStore, error) {
+  if path == "" {
+    return nil, base.ErrInvalidArgument
+  }
+  db, e := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+  if e != nil {
+    return nil, e
+  }
+  e = db.Update(func(tx *bolt.Tx) error {
+    _, e := tx.CreateBucketIfNotExists(jobsBucket)
+    return e
+  })
+  if e != nil {
+    db.Close()
+    return nil, e
+  }
+  return &BoltStore{db: db}, nil
+}
+
+func (s *BoltStore) Put(job *Job) error {
+  if job == nil {
+    return base.ErrInvalidArgument
+  }
+  data, e := json.Marshal(job)
+  if e != nil {
+    return e
+  }
+  return s.db.Update(func(tx *bolt.Tx) error {
+    return tx.Bucket(jobsBucket).Put([]byte(job.key()), data)
+  })
+}
+
+func (s *BoltStore) Jobs() ([]*Job, error) {
+  var ret []*Job
+  e := s.db.View(func(tx *bolt.Tx) error {
+    return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+      job := &Job{}
+      if e := json.Unmarshal(v, job); e != nil {
+        return e
+      }
+      ret = append(ret, job)
+      return nil
+    })
+  })
+  if e != nil {
+    return nil, e
+  }
+  return ret, nil
+}
+
+func (s *BoltStore) Close() error {
+  return s.db.Close()
+}
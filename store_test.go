@@ -0,0 +1,92 @@
+package collector
+
+import (
+  "context"
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "testing"
+)
+
+type resumeHandler struct {
+  c     *Crawler
+  stop  int
+  loops []int
+}
+
+func (h *resumeHandler) OnFields(p *Page, data Record) {
+}
+
+func (h *resumeHandler) OnLoop(p *Page, i int, data []interface{}) bool {
+  h.loops = append(h.loops, i)
+  if i == h.stop {
+    // 模拟进程退出
+    h.c.Stop()
+  }
+  return i < 4
+}
+
+func (h *resumeHandler) OnComplete(p *Page) {
+}
+
+func TestCrawlerRestore(t *testing.T) {
+  dir, e := ioutil.TempDir("", "store")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  path := filepath.Join(dir, "jobs.db")
+
+  rs := NewRuleSet()
+  if e := rs.AppendBytes(crawlRules); e != nil {
+    t.Fatal(e)
+  }
+  evalTrue := fakeNewTab(func(string) interface{} { return "true" })
+
+  s, e := OpenBoltStore(path)
+  if e != nil {
+    t.Fatal(e)
+  }
+  h := &resumeHandler{stop: 2}
+  h.c = newCrawler(context.Background(), evalTrue, rs, h, 1, 0)
+  if e := h.c.Restore(s); e != nil {
+    t.Fatal(e)
+  }
+  h.c.Enqueue("http://list.com/", "list")
+  h.c.Wait()
+  if len(h.loops) != 2 {
+    t.Fatalf("unexpected loops %v", h.loops)
+  }
+  s.Close()
+
+  s, e = OpenBoltStore(path)
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer s.Close()
+  jobs, e := s.Jobs()
+  if e != nil {
+    t.Fatal(e)
+  }
+  if len(jobs) != 1 || jobs[0].State != JobPending || jobs[0].LoopCount != 2 || jobs[0].Attempts != 1 {
+    t.Fatalf("unexpected jobs %+v", jobs[0])
+  }
+
+  h = &resumeHandler{}
+  h.c = newCrawler(context.Background(), evalTrue, rs, h, 1, 0)
+  if e := h.c.Restore(s); e != nil {
+    t.Fatal(e)
+  }
+  // 已经添加过
+  if h.c.Enqueue("http://list.com/", "list") {
+    t.Fatal("restored job enqueued again")
+  }
+  h.c.Wait()
+  if len(h.loops) != 2 || h.loops[0] != 3 || h.loops[1] != 4 {
+    t.Fatalf("loop not resumed: %v", h.loops)
+  }
+  jobs, _ = s.Jobs()
+  if len(jobs) != 1 || jobs[0].State != JobDone || jobs[0].Attempts != 2 {
+    t.Fatalf("unexpected jobs %+v", jobs[0])
+  }
+}
@@ -0,0 +1,138 @@
+package collector
+
+import (
+  "container/heap"
+  "sync"
+  "time"
+)
+
+// 所有Page共用的定时器（页面超时、field/loop的wait等）
+var timers = newTimerQueue()
+
+// 单个goroutine和一个最小堆管理所有定时器，
+// 只有堆顶的定时器使用time.Timer，添加和取消都是O(log n)，
+// 回调在该goroutine中执行，所以不能阻塞
+type timerQueue struct {
+  h       timerHeap
+  t       *time.Timer
+  wake    chan struct{}
+  running bool
+  mu      sync.Mutex
+}
+
+type timer struct {
+  when time.Time
+  f    func()
+
+  // 在堆中的位置，-1表示已触发或已取消
+  index int
+}
+
+func newTimerQueue() *timerQueue {
+  return &timerQueue{wake: make(chan struct{}, 1)}
+}
+
+// d时间后执行f，返回的timer可以通过stop取消
+func (q *timerQueue) afterFunc(d time.Duration, f func()) *timer {
+  t := &timer{when: time.Now().Add(d), f: f}
+  q.mu.Lock()
+  heap.Push(&q.h, t)
+  first := t.index == 0
+  if !q.running {
+    q.running = true
+    q.t = time.NewTimer(d)
+    go q.run()
+  }
+  q.mu.Unlock()
+  if first {
+    // 新的定时器比之前的都早，需要重置time.Timer
+    select {
+    case q.wake <- struct{}{}:
+    default:
+    }
+  }
+  return t
+}
+
+// 取消定时器，如果已经触发或取消过返回false
+func (q *timerQueue) stop(t *timer) bool {
+  if t == nil {
+    return false
+  }
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  if t.index < 0 {
+    return false
+  }
+  heap.Remove(&q.h, t.index)
+  return true
+}
+
+// 等待中的定时器数量
+func (q *timerQueue) len() int {
+  q.mu.Lock()
+  defer q.mu.Unlock()
+  return len(q.h)
+}
+
+func (q *timerQueue) run() {
+  for {
+    select {
+    case <-q.t.C:
+    case <-q.wake:
+    }
+    q.mu.Lock()
+    now := time.Now()
+    var fs []func()
+    for len(q.h) > 0 && !q.h[0].when.After(now) {
+      fs = append(fs, heap.Pop(&q.h).(*timer).f)
+    }
+    d := time.Hour
+    if len(q.h) > 0 {
+      d = q.h[0].when.Sub(now)
+    }
+    if !q.t.Stop() {
+      select {
+      case <-q.t.C:
+      default:
+      }
+    }
+    q.t.Reset(d)
+    q.mu.Unlock()
+    for _, f := range fs {
+      f()
+    }
+  }
+}
+
+type timerHeap []*timer
+
+func (h timerHeap) Len() int {
+  return len(h)
+}
+
+func (h timerHeap) Less(i, j int) bool {
+  return h[i].when.Before(h[j].when)
+}
+
+func (h timerHeap) Swap(i, j int) {
+  h[i], h[j] = h[j], h[i]
+  h[i].index = i
+  h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+  t := x.(*timer)
+  t.index = len(*h)
+  *h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+  old := *h
+  n := len(old)
+  t := old[n-1]
+  old[n-1] = nil
+  t.index = -1
+  *h = old[:n-1]
+  return t
+}
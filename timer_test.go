@@ -0,0 +1,138 @@
+package collector
+
+import (
+  "runtime"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+)
+
+func TestTimerQueue(t *testing.T) {
+  q := newTimerQueue()
+  var mu sync.Mutex
+  var order []int
+  wg := &sync.WaitGroup{}
+  wg.Add(3)
+  for _, i := range []int{3, 1, 2} {
+    i := i
+    q.afterFunc(time.Duration(i)*20*time.Millisecond, func() {
+      mu.Lock()
+      order = append(order, i)
+      mu.Unlock()
+      wg.Done()
+    })
+  }
+  cancelled := q.afterFunc(10*time.Millisecond, func() {
+    t.Error("cancelled timer fired")
+  })
+  if !q.stop(cancelled) || q.stop(cancelled) {
+    t.Fatal("stop should succeed only once")
+  }
+  wg.Wait()
+  if len(order) != 3 || order[0] != 1 || order[1] != 2 || order[2] != 3 {
+    t.Fatalf("want [1 2 3], got %v", order)
+  }
+  if q.len() != 0 {
+    t.Fatalf("want empty queue, got %d", q.len())
+  }
+}
+
+func TestTimerQueueEarlier(t *testing.T) {
+  q := newTimerQueue()
+  q.afterFunc(time.Hour, func() {})
+  ch := make(chan struct{})
+  q.afterFunc(10*time.Millisecond, func() {
+    close(ch)
+  })
+  select {
+  case <-ch:
+  case <-time.After(time.Second):
+    t.Fatal("earlier timer not fired")
+  }
+}
+
+const benchPages = 100000
+
+// 每个页面一个超时定时器，采集完成后取消
+func BenchmarkTimerQueue(b *testing.B) {
+  // 所有迭代共用一个队列（与timers一样），队列的goroutine不会退出
+  g := runtime.NumGoroutine()
+  q := newTimerQueue()
+  for i := 0; i < b.N; i++ {
+    ts := make([]*timer, benchPages)
+    var fired int32
+    for j := range ts {
+      ts[j] = q.afterFunc(time.Minute, func() {
+        atomic.AddInt32(&fired, 1)
+      })
+    }
+    b.ReportMetric(float64(runtime.NumGoroutine()-g), "goroutines")
+    reportHeap(b)
+    for _, t := range ts {
+      q.stop(t)
+    }
+  }
+}
+
+func BenchmarkAfterFunc(b *testing.B) {
+  for i := 0; i < b.N; i++ {
+    g := runtime.NumGoroutine()
+    ts := make([]*time.Timer, benchPages)
+    var fired int32
+    for j := range ts {
+      ts[j] = time.AfterFunc(time.Minute, func() {
+        atomic.AddInt32(&fired, 1)
+      })
+    }
+    b.ReportMetric(float64(runtime.NumGoroutine()-g), "goroutines")
+    reportHeap(b)
+    for _, t := range ts {
+      t.Stop()
+    }
+  }
+}
+
+// 定时器全部触发时的goroutine数量（time.AfterFunc每个回调一个goroutine）
+func BenchmarkTimerQueueFire(b *testing.B) {
+  q := newTimerQueue()
+  for i := 0; i < b.N; i++ {
+    wg := &sync.WaitGroup{}
+    wg.Add(benchPages)
+    var peak int32
+    for j := 0; j < benchPages; j++ {
+      q.afterFunc(10*time.Millisecond, func() {
+        if n := int32(runtime.NumGoroutine()); n > atomic.LoadInt32(&peak) {
+          atomic.StoreInt32(&peak, n)
+        }
+        wg.Done()
+      })
+    }
+    wg.Wait()
+    b.ReportMetric(float64(peak), "peak-goroutines")
+  }
+}
+
+func BenchmarkAfterFuncFire(b *testing.B) {
+  for i := 0; i < b.N; i++ {
+    wg := &sync.WaitGroup{}
+    wg.Add(benchPages)
+    var peak int32
+    for j := 0; j < benchPages; j++ {
+      time.AfterFunc(10*time.Millisecond, func() {
+        if n := int32(runtime.NumGoroutine()); n > atomic.LoadInt32(&peak) {
+          atomic.StoreInt32(&peak, n)
+        }
+        wg.Done()
+      })
+    }
+    wg.Wait()
+    b.ReportMetric(float64(peak), "peak-goroutines")
+  }
+}
+
+func reportHeap(b *testing.B) {
+  var m runtime.MemStats
+  runtime.ReadMemStats(&m)
+  b.ReportMetric(float64(m.HeapInuse)/(1<<20), "heap-MB")
+}
@@ -0,0 +1,284 @@
+package collector
+
+import (
+  "errors"
+  "fmt"
+  "regexp"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/base"
+  "gopkg.in/yaml.v3"
+)
+
+var ErrUnknownTransform = errors.New("unknown transform")
+
+// 对eval（或value）的结果做处理，返回处理后的值
+type TransformFunc func(interface{}) (interface{}, error)
+
+// 用参数创建TransformFunc，在加载规则时调用，参数错误应返回error
+type TransformFactory func(args []string) (TransformFunc, error)
+
+var (
+  transformFactories = map[string]TransformFactory{
+    "trim":      newTrimTransform,
+    "lowercase": newLowercaseTransform,
+    "regex":     newRegexTransform,
+    "replace":   newReplaceTransform,
+    "split":     newSplitTransform,
+    "number":    newNumberTransform,
+    "cn_unit":   newCnUnitTransform,
+    "date":      newDateTransform,
+    "default":   newDefaultTransform,
+  }
+  transformMu sync.RWMutex
+)
+
+// 注册自定义的transform（同名会覆盖内置的），
+// 需要在加载规则之前调用
+func RegisterTransform(name string, factory TransformFactory) error {
+  if name == "" || factory == nil {
+    return base.ErrInvalidArgument
+  }
+  transformMu.Lock()
+  defer transformMu.Unlock()
+  transformFactories[name] = factory
+  return nil
+}
+
+// 规则中的transform，支持以下几种写法：
+//   - trim
+//   - regex: "(\\d+)"
+//   - replace: [",", ""]
+type Transform struct {
+  Name string
+  Args []string
+}
+
+func (t *Transform) UnmarshalYAML(node *yaml.Node) error {
+  switch node.Kind {
+  case yaml.ScalarNode:
+    t.Name = node.Value
+    return nil
+
+  case yaml.MappingNode:
+    if len(node.Content) != 2 {
+      return fmt.Errorf("line %d: transform must have exactly one key", node.Line)
+    }
+    t.Name = node.Content[0].Value
+    args := node.Content[1]
+    switch args.Kind {
+    case yaml.ScalarNode:
+      if args.Tag != "!!null" {
+        t.Args = []string{args.Value}
+      }
+      return nil
+    case yaml.SequenceNode:
+      return args.Decode(&t.Args)
+    }
+  }
+  return fmt.Errorf("line %d: invalid transform", node.Line)
+}
+
+func compileTransforms(ts []*Transform) ([]TransformFunc, error) {
+  if len(ts) == 0 {
+    return nil, nil
+  }
+  transformMu.RLock()
+  defer transformMu.RUnlock()
+  ret := make([]TransformFunc, 0, len(ts))
+  for _, t := range ts {
+    factory, ok := transformFactories[t.Name]
+    if !ok {
+      return nil, fmt.Errorf("%w: %s", ErrUnknownTransform, t.Name)
+    }
+    f, e := factory(t.Args)
+    if e != nil {
+      return nil, fmt.Errorf("transform %s: %w", t.Name, e)
+    }
+    ret = append(ret, f)
+  }
+  return ret, nil
+}
+
+func applyTransforms(fs []TransformFunc, v interface{}) (interface{}, error) {
+  var e error
+  for _, f := range fs {
+    v, e = f(v)
+    if e != nil {
+      return nil, e
+    }
+  }
+  return v, nil
+}
+
+// 把字符串处理函数包装为TransformFunc，
+// 如果值是数组（如all为true的selector），对每个元素分别处理
+func stringTransform(f func(string) (interface{}, error)) TransformFunc {
+  var tf TransformFunc
+  tf = func(v interface{}) (interface{}, error) {
+    switch val := v.(type) {
+    case string:
+      return f(val)
+    case []interface{}:
+      ret := make([]interface{}, len(val))
+      for i, item := range val {
+        r, e := tf(item)
+        if e != nil {
+          return nil, e
+        }
+        ret[i] = r
+      }
+      return ret, nil
+    case nil:
+      return f("")
+    case float64:
+      // 不丢失精度（如3.14159），整数不带小数点
+      return f(strconv.FormatFloat(val, 'f', -1, 64))
+    }
+    return f(fmt.Sprint(v))
+  }
+  return tf
+}
+
+func newTrimTransform(args []string) (TransformFunc, error) {
+  return stringTransform(func(s string) (interface{}, error) {
+    if len(args) > 0 {
+      return strings.Trim(s, args[0]), nil
+    }
+    return strings.TrimSpace(s), nil
+  }), nil
+}
+
+func newLowercaseTransform(args []string) (TransformFunc, error) {
+  return stringTransform(func(s string) (interface{}, error) {
+    return strings.ToLower(s), nil
+  }), nil
+}
+
+// 参数为正则表达式，返回第一个分组（没有分组则返回整个匹配），没有匹配返回空字符串
+func newRegexTransform(args []string) (TransformFunc, error) {
+  if len(args) != 1 {
+    return nil, errors.New("regex needs 1 argument")
+  }
+  re, e := regexp.Compile(args[0])
+  if e != nil {
+    return nil, e
+  }
+  return stringTransform(func(s string) (interface{}, error) {
+    m := re.FindStringSubmatch(s)
+    switch len(m) {
+    case 0:
+      return "", nil
+    case 1:
+      return m[0], nil
+    }
+    return m[1], nil
+  }), nil
+}
+
+// 参数为[old, new]
+func newReplaceTransform(args []string) (TransformFunc, error) {
+  if len(args) != 2 {
+    return nil, errors.New("replace needs 2 arguments")
+  }
+  return stringTransform(func(s string) (interface{}, error) {
+    return strings.ReplaceAll(s, args[0], args[1]), nil
+  }), nil
+}
+
+// 参数为分隔符，返回字符串数组（元素会去除首尾空白），数组的每个元素分别split
+func newSplitTransform(args []string) (TransformFunc, error) {
+  if len(args) != 1 || args[0] == "" {
+    return nil, errors.New("split needs 1 non-empty argument")
+  }
+  return stringTransform(func(s string) (interface{}, error) {
+    if s == "" {
+      return []interface{}{}, nil
+    }
+    arr := strings.Split(s, args[0])
+    ret := make([]interface{}, len(arr))
+    for i, item := range arr {
+      ret[i] = strings.TrimSpace(item)
+    }
+    return ret, nil
+  }), nil
+}
+
+// 解析数字（如"1,234.00"、"-3.5%"），返回float64
+func newNumberTransform(args []string) (TransformFunc, error) {
+  return stringTransform(parseNumber), nil
+}
+
+func parseNumber(s string) (interface{}, error) {
+  s = strings.TrimSpace(s)
+  s = strings.TrimSuffix(s, "%")
+  s = strings.NewReplacer(",", "", "，", "", " ", "").Replace(s)
+  f, e := strconv.ParseFloat(s, 64)
+  if e != nil {
+    return nil, fmt.Errorf("invalid number %q", s)
+  }
+  return f, nil
+}
+
+var cnUnits = []struct {
+  suffix string
+  n      float64
+}{
+  {"万亿", 1e12},
+  {"亿", 1e8},
+  {"万", 1e4},
+  {"千", 1e3},
+  {"百", 1e2},
+}
+
+// 解析带中文单位的数字（如"12.3亿"、"1,234.5万"），返回float64
+func newCnUnitTransform(args []string) (TransformFunc, error) {
+  return stringTransform(func(s string) (interface{}, error) {
+    s = strings.TrimSpace(s)
+    for _, u := range cnUnits {
+      if strings.HasSuffix(s, u.suffix) {
+        f, e := parseNumber(strings.TrimSuffix(s, u.suffix))
+        if e != nil {
+          return nil, e
+        }
+        return f.(float64) * u.n, nil
+      }
+    }
+    return parseNumber(s)
+  }), nil
+}
+
+// 参数为时间格式（Go的layout，如"2006年1月2日"）和可选的时区（如"Asia/Shanghai"，默认为本地时区），
+// 返回time.Time
+func newDateTransform(args []string) (TransformFunc, error) {
+  if len(args) == 0 || len(args) > 2 || args[0] == "" {
+    return nil, errors.New("date needs layout and optional location")
+  }
+  loc := time.Local
+  if len(args) == 2 {
+    l, e := time.LoadLocation(args[1])
+    if e != nil {
+      return nil, e
+    }
+    loc = l
+  }
+  return stringTransform(func(s string) (interface{}, error) {
+    return time.ParseInLocation(args[0], strings.TrimSpace(s), loc)
+  }), nil
+}
+
+// 参数为默认值，值为空（空字符串或undefined）时返回默认值
+func newDefaultTransform(args []string) (TransformFunc, error) {
+  if len(args) != 1 {
+    return nil, errors.New("default needs 1 argument")
+  }
+  return func(v interface{}) (interface{}, error) {
+    if v == nil || v == "" {
+      return args[0], nil
+    }
+    return v, nil
+  }, nil
+}
@@ -0,0 +1,120 @@
+package collector
+
+import (
+  "reflect"
+  "strings"
+  "testing"
+  "time"
+
+  "gopkg.in/yaml.v3"
+)
+
+func TestTransformYaml(t *testing.T) {
+  data := []byte(`
+- trim
+- regex: "(\\d+)"
+- replace: [",", ""]
+- date: ["2006年1月2日", "Asia/Shanghai"]
+`)
+  var ts []*Transform
+  if e := yaml.Unmarshal(data, &ts); e != nil {
+    t.Fatal(e)
+  }
+  want := []*Transform{
+    {Name: "trim"},
+    {Name: "regex", Args: []string{`(\d+)`}},
+    {Name: "replace", Args: []string{",", ""}},
+    {Name: "date", Args: []string{"2006年1月2日", "Asia/Shanghai"}},
+  }
+  if !reflect.DeepEqual(ts, want) {
+    t.Fatalf("unexpected %+v", ts)
+  }
+}
+
+func TestTransforms(t *testing.T) {
+  shanghai, _ := time.LoadLocation("Asia/Shanghai")
+  cases := []struct {
+    ts   []*Transform
+    in   interface{}
+    want interface{}
+  }{
+    {[]*Transform{{Name: "trim"}}, "  a b \n", "a b"},
+    {[]*Transform{{Name: "lowercase"}}, "ABC", "abc"},
+    {[]*Transform{{Name: "regex", Args: []string{`编号：(\w+)`}}}, "编号：A123 其它", "A123"},
+    {[]*Transform{{Name: "regex", Args: []string{`\d+`}}}, "abc", ""},
+    {[]*Transform{{Name: "replace", Args: []string{"-", "/"}}}, "2020-05-30", "2020/05/30"},
+    {[]*Transform{{Name: "split", Args: []string{","}}}, "a, b,c", []interface{}{"a", "b", "c"}},
+    {[]*Transform{{Name: "split", Args: []string{","}}}, []interface{}{"a,b", "c"}, []interface{}{[]interface{}{"a", "b"}, []interface{}{"c"}}},
+    {[]*Transform{{Name: "split", Args: []string{"."}}}, 3.14159, []interface{}{"3", "14159"}},
+    {[]*Transform{{Name: "split", Args: []string{","}}}, nil, []interface{}{}},
+    {[]*Transform{{Name: "number"}}, "1,234.00", 1234.0},
+    {[]*Transform{{Name: "number"}}, "-3.5%", -3.5},
+    {[]*Transform{{Name: "cn_unit"}}, "12.3亿", 12.3e8},
+    {[]*Transform{{Name: "cn_unit"}}, "1,234.5万", 1234.5e4},
+    {[]*Transform{{Name: "cn_unit"}}, "88", 88.0},
+    {[]*Transform{{Name: "date", Args: []string{"2006年1月2日", "Asia/Shanghai"}}}, "2020年5月30日", time.Date(2020, 5, 30, 0, 0, 0, 0, shanghai)},
+    {[]*Transform{{Name: "default", Args: []string{"N/A"}}}, "", "N/A"},
+    {[]*Transform{{Name: "trim"}, {Name: "default", Args: []string{"0"}}, {Name: "number"}}, "  ", 0.0},
+    {[]*Transform{{Name: "trim"}}, []interface{}{" a ", " b"}, []interface{}{"a", "b"}},
+    {[]*Transform{{Name: "trim"}}, 3.14159, "3.14159"},
+    {[]*Transform{{Name: "trim"}}, float64(12), "12"},
+    {[]*Transform{{Name: "trim"}}, false, "false"},
+  }
+  for _, c := range cases {
+    fs, e := compileTransforms(c.ts)
+    if e != nil {
+      t.Fatal(e)
+    }
+    v, e := applyTransforms(fs, c.in)
+    if e != nil {
+      t.Fatalf("%v: %v", c.in, e)
+    }
+    if tm, ok := v.(time.Time); ok {
+      if !tm.Equal(c.want.(time.Time)) {
+        t.Fatalf("%v: want %v, got %v", c.in, c.want, v)
+      }
+      continue
+    }
+    if !reflect.DeepEqual(v, c.want) {
+      t.Fatalf("%v: want %#v, got %#v", c.in, c.want, v)
+    }
+  }
+
+  fs, _ := compileTransforms([]*Transform{{Name: "number"}})
+  if _, e := applyTransforms(fs, "abc"); e == nil {
+    t.Fatal("want error")
+  }
+}
+
+func TestCompileTransformsError(t *testing.T) {
+  if _, e := compileTransforms([]*Transform{{Name: "nope"}}); e == nil || !strings.Contains(e.Error(), "nope") {
+    t.Fatalf("want unknown transform error, got %v", e)
+  }
+  if _, e := compileTransforms([]*Transform{{Name: "regex", Args: []string{"("}}}); e == nil {
+    t.Fatal("want regex error")
+  }
+}
+
+func TestRegisterTransform(t *testing.T) {
+  e := RegisterTransform("double", func(args []string) (TransformFunc, error) {
+    return func(v interface{}) (interface{}, error) {
+      return v.(float64) * 2, nil
+    }, nil
+  })
+  if e != nil {
+    t.Fatal(e)
+  }
+  // 不影响其它测试
+  t.Cleanup(func() {
+    transformMu.Lock()
+    delete(transformFactories, "double")
+    transformMu.Unlock()
+  })
+  fs, e := compileTransforms([]*Transform{{Name: "number"}, {Name: "double"}})
+  if e != nil {
+    t.Fatal(e)
+  }
+  if v, _ := applyTransforms(fs, "1.5"); v != 3.0 {
+    t.Fatalf("want 3, got %v", v)
+  }
+}
@@ -0,0 +1,166 @@
+package collector
+
+import (
+  "fmt"
+  "time"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/conv"
+  "gopkg.in/yaml.v3"
+)
+
+// 页面加载完成（开始采集）的时机
+const (
+  TriggerLoad                 = "load"
+  TriggerDomContentLoaded     = "dom_content_loaded"
+  TriggerNetworkIdle          = "network_idle"
+  TriggerFirstMeaningfulPaint = "first_meaningful_paint"
+  TriggerSelector             = "selector"
+)
+
+const setLifecycleEventsEnabled = "Page.setLifecycleEventsEnabled"
+
+// Page.lifecycleEvent的name
+var lifecycleNames = map[string]string{
+  TriggerNetworkIdle:          "networkIdle",
+  TriggerFirstMeaningfulPaint: "firstMeaningfulPaint",
+}
+
+// 可以是字符串（如"dom_content_loaded"），
+// 或者是只有一个key的map（如selector: "#list"，表示DOMContentLoaded之后等待元素出现）
+type Trigger struct {
+  Event    string
+  Selector string
+}
+
+func (t *Trigger) UnmarshalYAML(node *yaml.Node) error {
+  switch node.Kind {
+  case yaml.ScalarNode:
+    t.Event = node.Value
+    return nil
+
+  case yaml.MappingNode:
+    if len(node.Content) != 2 || node.Content[1].Kind != yaml.ScalarNode {
+      return fmt.Errorf("line %d: trigger must have exactly one key", node.Line)
+    }
+    t.Event = node.Content[0].Value
+    t.Selector = node.Content[1].Value
+    return nil
+  }
+  return fmt.Errorf("line %d: invalid trigger", node.Line)
+}
+
+func (t *Trigger) validate(v *validator, path ...interface{}) {
+  if t == nil {
+    return
+  }
+  switch t.Event {
+  case TriggerLoad, TriggerDomContentLoaded, TriggerNetworkIdle, TriggerFirstMeaningfulPaint:
+    if t.Selector != "" {
+      v.add(fmt.Sprintf("trigger %q does not take a value", t.Event), path...)
+    }
+  case TriggerSelector:
+    if t.Selector == "" {
+      v.add("trigger selector is empty", path...)
+    }
+  default:
+    v.add(fmt.Sprintf("unknown trigger %q", t.Event), path...)
+  }
+}
+
+func (t *Trigger) event() string {
+  if t == nil || t.Event == "" {
+    return TriggerLoad
+  }
+  return t.Event
+}
+
+// 需要订阅的事件，lifecycle表示是否需要开启Page.lifecycleEvent
+func (t *Trigger) events() (events []string, lifecycle bool) {
+  switch t.event() {
+  case TriggerDomContentLoaded, TriggerSelector:
+    return []string{cdp.Page.DomContentEventFired}, false
+  case TriggerNetworkIdle, TriggerFirstMeaningfulPaint:
+    return []string{cdp.Page.LifecycleEvent}, true
+  }
+  return nil, false
+}
+
+// 页面某个frame的生命周期事件
+type lifecycle struct {
+  frameId  string
+  loaderId string
+  name     string
+}
+
+// 检查事件是否触发了采集（超时不在这里处理）
+func (a *attempt) triggered(msg *cdp.Message) bool {
+  t := a.p.Rule.Trigger
+  switch msg.Method {
+  case cdp.Page.LoadEventFired:
+    return t.event() == TriggerLoad
+  case cdp.Page.DomContentEventFired:
+    e := t.event()
+    return e == TriggerDomContentLoaded || e == TriggerSelector
+  case cdp.Page.LifecycleEvent:
+    name, ok := lifecycleNames[t.event()]
+    if !ok {
+      return false
+    }
+    ev := lifecycle{
+      frameId:  conv.GetString(msg.Params, "frameId", ""),
+      loaderId: conv.GetString(msg.Params, "loaderId", ""),
+      name:     conv.GetString(msg.Params, "name", ""),
+    }
+    if ev.name != name {
+      return false
+    }
+    a.mu.Lock()
+    defer a.mu.Unlock()
+    if a.frameId == "" {
+      // Page.navigate还没有返回，等返回后再检查
+      a.lifecycle = append(a.lifecycle, ev)
+      return false
+    }
+    return a.isMainFrame(ev)
+  }
+  return false
+}
+
+// Page.navigate返回后调用，检查之前收到的生命周期事件
+func (a *attempt) navigated(frameId, loaderId string) bool {
+  a.mu.Lock()
+  defer a.mu.Unlock()
+  a.frameId, a.loaderId = frameId, loaderId
+  for _, ev := range a.lifecycle {
+    if a.isMainFrame(ev) {
+      return true
+    }
+  }
+  a.lifecycle = nil
+  return false
+}
+
+// 只处理本次导航的主frame，
+// loaderId用于区分导航前的文档（同一文档内的导航没有loaderId）
+func (a *attempt) isMainFrame(ev lifecycle) bool {
+  if ev.frameId != a.frameId {
+    return false
+  }
+  return a.loaderId == "" || ev.loaderId == a.loaderId
+}
+
+// trigger为selector时，等待元素出现（最多等到页面超时）
+func (p *Page) waitTrigger(a *attempt) error {
+  t := p.Rule.Trigger
+  if t.event() != TriggerSelector || a.timedOut() {
+    return nil
+  }
+  w := &WaitFor{Selector: t.Selector}
+  w.init()
+  w.timeout = p.Rule.timeout - time.Since(a.started)
+  if w.timeout <= 0 {
+    return &WaitError{Cond: w.String(), Timeout: p.Rule.timeout}
+  }
+  return p.waitFor(w, "")
+}
@@ -0,0 +1,131 @@
+package collector
+
+import (
+  "context"
+  "errors"
+  "strings"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+func lifecycleEvent(frameId, loaderId, name string) *cdp.Message {
+  return &cdp.Message{Method: cdp.Page.LifecycleEvent, Params: map[string]interface{}{"frameId": frameId, "loaderId": loaderId, "name": name}}
+}
+
+func TestTriggerLifecycle(t *testing.T) {
+  r, e := ParseRule([]byte(`id: "t"
+group: "g"
+patterns: ["x"]
+trigger: "network_idle"
+fields:
+  - name: "a"
+    eval: "1"
+`))
+  if e != nil {
+    t.Fatal(e)
+  }
+  a := &attempt{p: &Page{Rule: r}}
+  if a.triggered(&cdp.Message{Method: cdp.Page.LoadEventFired}) {
+    t.Fatal("load should not trigger")
+  }
+  // Page.navigate返回前收到的事件
+  a.triggered(lifecycleEvent("1", "0", "networkIdle"))
+  a.triggered(lifecycleEvent("2", "1", "networkIdle"))
+  if a.navigated("1", "1") {
+    t.Fatal("events of other documents or frames should not trigger")
+  }
+  if a.triggered(lifecycleEvent("1", "1", "load")) {
+    t.Fatal("other lifecycle event should not trigger")
+  }
+  if !a.triggered(lifecycleEvent("1", "1", "networkIdle")) {
+    t.Fatal("networkIdle of main frame should trigger")
+  }
+
+  a = &attempt{p: &Page{Rule: r}}
+  a.triggered(lifecycleEvent("1", "1", "networkIdle"))
+  if !a.navigated("1", "1") {
+    t.Fatal("buffered networkIdle should trigger")
+  }
+}
+
+func TestTriggerSelector(t *testing.T) {
+  rg := NewRuleGroup("g")
+  e := rg.AppendBytes([]byte(`id: "t"
+group: "g"
+patterns: ["example.com"]
+timeout: "1s"
+trigger:
+  selector: "#list"
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+`))
+  if e != nil {
+    t.Fatal(e)
+  }
+  var polls int32
+  evalFunc := func(expr string) interface{} {
+    if strings.Contains(expr, `"#list"`) {
+      return atomic.AddInt32(&polls, 1) >= 2
+    }
+    return "ok"
+  }
+  p := NewPage("http://example.com", "g")
+  h := &errHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  if e := p.collect(context.Background(), fakeNewTab(evalFunc), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if polls != 2 || h.record["a"] != "ok" || len(h.errs) != 0 {
+    t.Fatalf("unexpected polls %d, record %v, errors %v", polls, h.record, h.errs)
+  }
+}
+
+func TestTriggerSelectorTimeout(t *testing.T) {
+  rg := NewRuleGroup("g")
+  e := rg.AppendBytes([]byte(`id: "t"
+group: "g"
+patterns: ["example.com"]
+timeout: "50ms"
+trigger:
+  selector: "#list"
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+`))
+  if e != nil {
+    t.Fatal(e)
+  }
+  p := NewPage("http://example.com", "g")
+  h := &errHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  if e := p.collect(context.Background(), fakeNewTab(func(string) interface{} { return false }), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  var we *WaitError
+  if len(h.errs) != 1 || !errors.As(h.errs[0], &we) {
+    t.Fatalf("want 1 *WaitError, got %v", h.errs)
+  }
+}
+
+func TestValidateTrigger(t *testing.T) {
+  for _, s := range []string{`"nope"`, `"selector"`, `{load: "x"}`, `[1]`} {
+    _, e := ParseRule([]byte("id: \"t\"\ngroup: \"g\"\npatterns: [\"x\"]\ntrigger: " + s + "\nfields:\n  - name: \"a\"\n    eval: \"1\"\n"))
+    if e == nil {
+      t.Errorf("%s: want error", s)
+    }
+  }
+}
@@ -0,0 +1,269 @@
+package collector
+
+import (
+  "fmt"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+
+  "gopkg.in/yaml.v3"
+)
+
+// field的name会作为Javascript全局变量名的一部分（cdp_field_<name>）
+var fieldNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_$]+$`)
+
+// 如zh-CN、en_US、zh-Hans-CN
+var localeRegexp = regexp.MustCompile(`^[A-Za-z]{2,3}([_-][A-Za-z0-9]{2,8})*$`)
+
+// IANA时区名称，如UTC、Asia/Shanghai、America/Argentina/Buenos_Aires、Etc/GMT+8
+var timezoneRegexp = regexp.MustCompile(`^[A-Za-z_]+(/[A-Za-z0-9_+-]+)*$`)
+
+// 规则中的一个问题，Line和Column是YAML中的位置（从1开始），
+// 没有YAML（如在Go中直接构造Rule）时为0
+type Problem struct {
+  // 多文档YAML中的第几个文档（从1开始），单个规则时为0
+  Document int
+
+  Line   int
+  Column int
+
+  // 出问题的字段路径，如fields[2].wait
+  Path string
+
+  Msg string
+}
+
+func (p *Problem) String() string {
+  var s string
+  switch {
+  case p.Line > 0:
+    s = fmt.Sprintf("%d:%d %s: %s", p.Line, p.Column, p.Path, p.Msg)
+  case p.Path != "":
+    s = fmt.Sprintf("%s: %s", p.Path, p.Msg)
+  default:
+    s = p.Msg
+  }
+  if p.Document > 0 {
+    s = fmt.Sprintf("document %d: %s", p.Document, s)
+  }
+  return s
+}
+
+// 规则校验错误，包含所有问题，
+// 多文档YAML中所有出错文档的问题合并在一起（Id为出错规则的Id，以逗号分隔）
+type ValidationError struct {
+  Id       string
+  Problems []*Problem
+}
+
+func (e *ValidationError) Error() string {
+  arr := make([]string, len(e.Problems))
+  for i, p := range e.Problems {
+    arr[i] = p.String()
+  }
+  return fmt.Sprintf("invalid rule %q: %s", e.Id, strings.Join(arr, "; "))
+}
+
+type validator struct {
+  root     *yaml.Node
+  problems []*Problem
+}
+
+// 按路径查找YAML节点，路径元素为string（map的key）或int（数组下标），
+// 找不到时返回能找到的最深的节点
+func (v *validator) node(path ...interface{}) *yaml.Node {
+  n := v.root
+  if n == nil {
+    return nil
+  }
+  if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+    n = n.Content[0]
+  }
+  for _, p := range path {
+    var next *yaml.Node
+    switch k := p.(type) {
+    case string:
+      if n.Kind == yaml.MappingNode {
+        for i := 0; i+1 < len(n.Content); i += 2 {
+          if n.Content[i].Value == k {
+            next = n.Content[i+1]
+            break
+          }
+        }
+      }
+    case int:
+      if n.Kind == yaml.SequenceNode && k < len(n.Content) {
+        next = n.Content[k]
+      }
+    }
+    if next == nil {
+      return n
+    }
+    n = next
+  }
+  return n
+}
+
+func (v *validator) add(msg string, path ...interface{}) {
+  p := &Problem{Path: formatPath(path), Msg: msg}
+  if n := v.node(path...); n != nil {
+    p.Line, p.Column = n.Line, n.Column
+  }
+  v.problems = append(v.problems, p)
+}
+
+// 时长可以为0（如wait、backoff），但不能为负数
+func (v *validator) duration(s string, path ...interface{}) {
+  if s == "" {
+    return
+  }
+  d, e := time.ParseDuration(s)
+  if e != nil {
+    v.add(fmt.Sprintf("invalid duration %q", s), path...)
+  } else if d < 0 {
+    v.add(fmt.Sprintf("duration %q must not be negative", s), path...)
+  }
+}
+
+// 时长必须大于0（如timeout、interval）
+func (v *validator) positive(s string, path ...interface{}) {
+  if s == "" {
+    return
+  }
+  d, e := time.ParseDuration(s)
+  if e != nil {
+    v.add(fmt.Sprintf("invalid duration %q", s), path...)
+  } else if d <= 0 {
+    v.add(fmt.Sprintf("duration %q must be positive", s), path...)
+  }
+}
+
+func (v *validator) typ(typ string, path ...interface{}) {
+  switch typ {
+  case "", TypeString, TypeInt, TypeFloat, TypeBool, TypeJson, TypeArray, TypeObject:
+  default:
+    v.add(fmt.Sprintf("unknown type %q", typ), path...)
+  }
+}
+
+func (v *validator) transforms(ts []*Transform, path ...interface{}) {
+  for i, t := range ts {
+    if _, e := compileTransforms([]*Transform{t}); e != nil {
+      v.add(e.Error(), sub(path, i)...)
+    }
+  }
+}
+
+func (v *validator) waitFor(ws []*WaitFor, path ...interface{}) {
+  for i, w := range ws {
+    if w == nil {
+      v.add("empty wait_for", sub(path, i)...)
+      continue
+    }
+    w.validate(v, sub(path, i)...)
+  }
+}
+
+// 子路径（不修改path）
+func sub(path []interface{}, elems ...interface{}) []interface{} {
+  return append(path[:len(path):len(path)], elems...)
+}
+
+func formatPath(path []interface{}) string {
+  var sb strings.Builder
+  for _, p := range path {
+    switch k := p.(type) {
+    case string:
+      if sb.Len() > 0 {
+        sb.WriteByte('.')
+      }
+      sb.WriteString(k)
+    case int:
+      sb.WriteString("[" + strconv.Itoa(k) + "]")
+    }
+  }
+  return sb.String()
+}
+
+// 校验规则（不需要浏览器），
+// 如果有问题，返回*ValidationError（包含所有问题及其在YAML中的位置）
+func (r *Rule) Validate() error {
+  v := &validator{root: r.node}
+  if r.Id == "" {
+    v.add("id is required", "id")
+  }
+  if r.Group == "" {
+    v.add("group is required", "group")
+  }
+  if len(r.Patterns) == 0 {
+    v.add("patterns must not be empty", "patterns")
+  }
+  for i, p := range r.Patterns {
+    if p == "" {
+      v.add("empty pattern", "patterns", i)
+    } else if _, e := regexp.Compile(p); e != nil {
+      v.add(e.Error(), "patterns", i)
+    }
+  }
+  r.Prepare.validate(v, "prepare")
+  v.positive(r.Timeout, "timeout")
+  r.Trigger.validate(v, "trigger")
+  responses := make(map[string]int, len(r.Responses))
+  for i, resp := range r.Responses {
+    if resp == nil {
+      v.add("empty response", "responses", i)
+      continue
+    }
+    if j, ok := responses[resp.Name]; ok {
+      v.add(fmt.Sprintf("duplicate name %q (same as responses[%d])", resp.Name, j), "responses", i, "name")
+    } else if resp.Name != "" {
+      responses[resp.Name] = i
+    }
+    resp.validate(v, "responses", i)
+  }
+  r.Block.validate(v, "block")
+  validateHeaders(v, r.Headers, "headers")
+  for i, c := range r.Cookies {
+    if c == nil {
+      v.add("empty cookie", "cookies", i)
+      continue
+    }
+    c.validate(v, "cookies", i)
+  }
+  r.Login.validate(v, "login")
+  validateProxy(v, r.Proxy, "proxy")
+  r.Emulation.validate(v, "emulation")
+  captures := make(map[string]int, len(r.Captures))
+  for i, c := range r.Captures {
+    if c == nil {
+      v.add("empty capture", "capture", i)
+      continue
+    }
+    if j, ok := captures[c.Name]; ok {
+      v.add(fmt.Sprintf("duplicate name %q (same as capture[%d])", c.Name, j), "capture", i, "name")
+    } else if c.Name != "" {
+      captures[c.Name] = i
+    }
+    c.validate(v, r.Loop != nil, "capture", i)
+  }
+  names := make(map[string]int, len(r.Fields))
+  for i, f := range r.Fields {
+    if f == nil {
+      v.add("empty field", "fields", i)
+      continue
+    }
+    if j, ok := names[f.Name]; ok {
+      v.add(fmt.Sprintf("duplicate name %q (same as fields[%d])", f.Name, j), "fields", i, "name")
+    } else if fieldNameRegexp.MatchString(f.Name) {
+      names[f.Name] = i
+    }
+    f.validate(v, responses, "fields", i)
+  }
+  r.Loop.validate(v, responses, "loop")
+  r.Retry.validate(v, r.Fields, names, "retry")
+  if len(v.problems) > 0 {
+    return &ValidationError{Id: r.Id, Problems: v.problems}
+  }
+  return nil
+}
@@ -0,0 +1,149 @@
+package collector
+
+import (
+  "io/ioutil"
+  "strings"
+  "testing"
+)
+
+func TestValidateExamples(t *testing.T) {
+  data, e := ioutil.ReadFile("rule.yml")
+  if e != nil {
+    t.Fatal(e)
+  }
+  for _, b := range [][]byte{data, listRule, detailRule, rule1, rule2} {
+    if _, e := ParseRule(b); e != nil {
+      t.Fatal(e)
+    }
+  }
+}
+
+func TestValidate(t *testing.T) {
+  data := []byte(`id: "bad"
+group: "g"
+patterns:
+  - "("
+  - ""
+timeout: "3o s"
+fields:
+  - name: "a"
+    eval: "1"
+    wait: "2 s"
+  - name: "a"
+    value: "2"
+    type: "integer"
+  - name: "b-c"
+    selector: "p"
+    eval: "1"
+  - name: "d"
+    transforms:
+      - regex: "("
+      - nope
+loop:
+  name: "l"
+  wait: "1s"
+`)
+  _, e := ParseRule(data)
+  ve, ok := e.(*ValidationError)
+  if !ok {
+    t.Fatalf("want *ValidationError, got %v", e)
+  }
+  want := []string{
+    "4:5 patterns[0]: ",
+    "5:5 patterns[1]: empty pattern",
+    `6:10 timeout: invalid duration "3o s"`,
+    `10:11 fields[0].wait: invalid duration "2 s"`,
+    `11:11 fields[1].name: duplicate name "a"`,
+    `13:11 fields[1].type: unknown type "integer"`,
+    `14:11 fields[2].name: invalid name "b-c"`,
+    "16:11 fields[2].eval: eval can not be used with selector or xpath",
+    "17:5 fields[3]: one of eval, value, selector, xpath or response is required",
+    "19:9 fields[3].transforms[0]: ",
+    "20:9 fields[3].transforms[1]: unknown transform",
+    "22:3 loop: loop without eval",
+  }
+  if len(ve.Problems) != len(want) {
+    t.Fatalf("want %d problems, got %d: %v", len(want), len(ve.Problems), ve)
+  }
+  for i, p := range ve.Problems {
+    if !strings.HasPrefix(p.String(), want[i]) {
+      t.Errorf("problem %d: want prefix %q, got %q", i, want[i], p.String())
+    }
+  }
+}
+
+func TestValidateWithoutYaml(t *testing.T) {
+  r := &Rule{Id: "1", Group: "g", Patterns: []string{"x"}, Fields: []*Field{{Name: "a"}}}
+  e := r.Validate()
+  if e == nil || !strings.Contains(e.Error(), "fields[0]: one of eval") {
+    t.Fatalf("unexpected %v", e)
+  }
+  r.Fields[0].Eval = "1"
+  if e := r.Validate(); e != nil {
+    t.Fatal(e)
+  }
+}
+
+func TestValidateDocuments(t *testing.T) {
+  rg := NewRuleGroup("g")
+  e := rg.AppendBytes([]byte(`id: "1"
+group: "g"
+patterns: ["a.com"]
+timeout: "x"
+---
+id: "2"
+group: "g"
+patterns: ["b.com"]
+fields:
+  - name: "a"
+    eval: "1"
+---
+id: "3"
+group: "g"
+patterns: []
+fields:
+  - name: "a"
+    eval: "1"
+`))
+  ve, ok := e.(*ValidationError)
+  if !ok {
+    t.Fatalf("want *ValidationError, got %v", e)
+  }
+  if ve.Id != "1,3" || len(ve.Problems) != 2 {
+    t.Fatalf("unexpected %v", ve)
+  }
+  for i, want := range []string{"document 1: 4:10 timeout", "document 3: 15:11 patterns"} {
+    if !strings.HasPrefix(ve.Problems[i].String(), want) {
+      t.Errorf("problem %d: want prefix %q, got %q", i, want, ve.Problems[i].String())
+    }
+  }
+}
+
+func TestValidateDurations(t *testing.T) {
+  r := &Rule{
+    Id: "1", Group: "g", Patterns: []string{"x"},
+    Prepare: &Prepare{Wait: "0s"},
+    Fields:  []*Field{{Name: "a", Eval: "1", Wait: "0s"}},
+    Retry:   &Retry{Backoff: "0s", MaxBackoff: "0s"},
+  }
+  if e := r.Validate(); e != nil {
+    t.Fatal(e)
+  }
+  r.Timeout = "0s"
+  r.Fields[0].Wait = "-1s"
+  // network_idle为0时没有意义
+  r.Fields[0].WaitFor = []*WaitFor{{NetworkIdle: "0s"}}
+  ve, ok := r.Validate().(*ValidationError)
+  if !ok || len(ve.Problems) != 3 {
+    t.Fatalf("unexpected %v", ve)
+  }
+  for i, want := range []string{
+    `timeout: duration "0s" must be positive`,
+    `fields[0].wait: duration "-1s" must not be negative`,
+    `fields[0].wait_for[0].network_idle: duration "0s" must be positive`,
+  } {
+    if ve.Problems[i].String() != want {
+      t.Errorf("problem %d: want %q, got %q", i, want, ve.Problems[i].String())
+    }
+  }
+}
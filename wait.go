@@ -0,0 +1,286 @@
+package collector
+
+import (
+  "fmt"
+  "regexp"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/cdp"
+  "github.com/kwf2030/commons/conv"
+)
+
+// 等待条件超时
+type WaitError struct {
+  Cond    string
+  Timeout time.Duration
+}
+
+func (e *WaitError) Error() string {
+  return fmt.Sprintf("wait for %s timeout after %s", e.Cond, e.Timeout)
+}
+
+// 等待条件（wait_for），每个条件只能设置一种，
+// 可以在所有允许wait的地方使用（prepare、field、loop），
+// 多个条件按顺序等待，全部满足后再按wait等待
+type WaitFor struct {
+  // 元素出现
+  Selector string `yaml:"selector"`
+
+  // 元素消失
+  Gone string `yaml:"gone"`
+
+  // Javascript表达式的值为真（truthy）
+  Eval string `yaml:"eval"`
+
+  // 没有进行中的请求且持续该时间
+  NetworkIdle string        `yaml:"network_idle"`
+  networkIdle time.Duration `yaml:"-"`
+
+  // 文本（in指定的元素，默认为body）匹配正则表达式
+  Text string         `yaml:"text"`
+  In   string         `yaml:"in"`
+  text *regexp.Regexp `yaml:"-"`
+
+  // URL匹配正则表达式
+  Url string         `yaml:"url"`
+  url *regexp.Regexp `yaml:"-"`
+
+  // URL发生变化（与该步骤执行前相比）
+  UrlChange bool `yaml:"url_change"`
+
+  // 超时时间（默认为10s），超时会报告*WaitError
+  Timeout string        `yaml:"timeout"`
+  timeout time.Duration `yaml:"-"`
+
+  // 轮询间隔（默认为100ms，network_idle不需要执行表达式，但同样按该间隔检查）
+  Interval string        `yaml:"interval"`
+  interval time.Duration `yaml:"-"`
+
+  // 轮询的表达式
+  expr string `yaml:"-"`
+}
+
+func (w *WaitFor) init() {
+  w.timeout = time.Second * 10
+  if w.Timeout != "" {
+    w.timeout, _ = time.ParseDuration(w.Timeout)
+  }
+  w.interval = time.Millisecond * 100
+  if w.Interval != "" {
+    w.interval, _ = time.ParseDuration(w.Interval)
+  }
+  switch {
+  case w.Selector != "":
+    w.expr = "document.querySelector(" + jsString(w.Selector) + ")!==null"
+  case w.Gone != "":
+    w.expr = "document.querySelector(" + jsString(w.Gone) + ")===null"
+  case w.Eval != "":
+    // 直接执行（页面的CSP可能不允许eval），真值在Go中判断
+    w.expr = blockExpr(w.Eval)
+  case w.NetworkIdle != "":
+    w.networkIdle, _ = time.ParseDuration(w.NetworkIdle)
+  case w.Text != "":
+    w.text, _ = regexp.Compile(w.Text)
+    if w.In != "" {
+      w.expr = "(function(){let n=document.querySelector(" + jsString(w.In) + ");return n?n.innerText:'';})()"
+    } else {
+      w.expr = "document.body?document.body.innerText:''"
+    }
+  case w.Url != "":
+    w.url, _ = regexp.Compile(w.Url)
+    w.expr = "location.href"
+  case w.UrlChange:
+    w.expr = "location.href"
+  }
+}
+
+func (w *WaitFor) validate(v *validator, path ...interface{}) {
+  switch w.count() {
+  case 0:
+    v.add("one of selector, gone, eval, network_idle, text, url or url_change is required", path...)
+  case 1:
+  default:
+    v.add("only one condition is allowed", path...)
+  }
+  v.positive(w.NetworkIdle, sub(path, "network_idle")...)
+  v.positive(w.Timeout, sub(path, "timeout")...)
+  v.positive(w.Interval, sub(path, "interval")...)
+  if w.Text != "" {
+    if _, e := regexp.Compile(w.Text); e != nil {
+      v.add(e.Error(), sub(path, "text")...)
+    }
+  } else if w.In != "" {
+    v.add("in requires text", sub(path, "in")...)
+  }
+  if w.Url != "" {
+    if _, e := regexp.Compile(w.Url); e != nil {
+      v.add(e.Error(), sub(path, "url")...)
+    }
+  }
+}
+
+// 条件的描述（用于错误信息）
+func (w *WaitFor) String() string {
+  switch {
+  case w.Selector != "":
+    return "selector " + w.Selector
+  case w.Gone != "":
+    return "gone " + w.Gone
+  case w.Eval != "":
+    return "eval " + w.Eval
+  case w.NetworkIdle != "":
+    return "network_idle " + w.NetworkIdle
+  case w.Text != "":
+    return "text " + w.Text
+  case w.Url != "":
+    return "url " + w.Url
+  case w.UrlChange:
+    return "url_change"
+  }
+  return ""
+}
+
+// 条件的个数（只能有一个）
+func (w *WaitFor) count() int {
+  n := 0
+  for _, b := range []bool{w.Selector != "", w.Gone != "", w.Eval != "", w.NetworkIdle != "", w.Text != "", w.Url != "", w.UrlChange} {
+    if b {
+      n++
+    }
+  }
+  return n
+}
+
+func initWaitFor(ws []*WaitFor) {
+  for _, w := range ws {
+    w.init()
+  }
+}
+
+func needNetwork(ws []*WaitFor) bool {
+  for _, w := range ws {
+    if w.NetworkIdle != "" {
+      return true
+    }
+  }
+  return false
+}
+
+func needUrl(ws []*WaitFor) bool {
+  for _, w := range ws {
+    if w.UrlChange {
+      return true
+    }
+  }
+  return false
+}
+
+// 记录进行中的请求（只有需要network_idle时才会开启Network），
+// Network事件在不同的goroutine中分发，loadingFinished可能先于requestWillBeSent到达
+type network struct {
+  requests map[string]struct{}
+
+  // 先收到结束事件的请求，之后的requestWillBeSent忽略
+  finished map[string]struct{}
+
+  last time.Time
+  mu   sync.Mutex
+}
+
+func newNetwork() *network {
+  return &network{requests: make(map[string]struct{}, 16), finished: make(map[string]struct{}, 4), last: time.Now()}
+}
+
+func (n *network) onEvent(msg *cdp.Message) {
+  id := conv.GetString(msg.Params, "requestId", "")
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  switch msg.Method {
+  case cdp.Network.RequestWillBeSent:
+    if _, ok := n.finished[id]; ok {
+      delete(n.finished, id)
+    } else {
+      n.requests[id] = struct{}{}
+    }
+  case cdp.Network.LoadingFinished, cdp.Network.LoadingFailed:
+    if _, ok := n.requests[id]; ok {
+      delete(n.requests, id)
+    } else {
+      n.finished[id] = struct{}{}
+    }
+  default:
+    return
+  }
+  n.last = time.Now()
+}
+
+func (n *network) idle(d time.Duration) bool {
+  n.mu.Lock()
+  defer n.mu.Unlock()
+  return len(n.requests) == 0 && time.Since(n.last) >= d
+}
+
+// 如果有url_change条件，返回当前URL（在执行该步骤前调用）
+func (p *Page) href(ws []*WaitFor) string {
+  if !needUrl(ws) {
+    return ""
+  }
+  msg, e := p.eval(map[string]interface{}{"expression": "location.href", "returnByValue": true})
+  if e != nil {
+    return ""
+  }
+  return conv.String(resultValue(msg), "")
+}
+
+// 按顺序等待所有条件满足后，再等待d时间
+func (p *Page) wait(d time.Duration, ws []*WaitFor, href string) error {
+  for _, w := range ws {
+    if e := p.waitFor(w, href); e != nil {
+      return e
+    }
+  }
+  return p.sleep(d)
+}
+
+func (p *Page) waitFor(w *WaitFor, href string) error {
+  params := map[string]interface{}{"expression": w.expr, "returnByValue": true}
+  deadline := time.Now().Add(w.timeout)
+  for {
+    ok := false
+    if w.networkIdle > 0 {
+      if a := p.current(); a != nil && a.network != nil {
+        ok = a.network.idle(w.networkIdle)
+      }
+    } else {
+      msg, e := p.eval(params)
+      if e != nil && p.ctx.Err() != nil {
+        return e
+      }
+      // 页面跳转时eval可能出错，继续轮询
+      if e == nil {
+        v := resultValue(msg)
+        switch {
+        case w.text != nil:
+          ok = w.text.MatchString(conv.String(v, ""))
+        case w.url != nil:
+          ok = w.url.MatchString(conv.String(v, ""))
+        case w.UrlChange:
+          s := conv.String(v, "")
+          ok = s != "" && s != href
+        default:
+          ok = truthy(v)
+        }
+      }
+    }
+    if ok {
+      return nil
+    }
+    if !time.Now().Before(deadline) {
+      return &WaitError{Cond: w.String(), Timeout: w.timeout}
+    }
+    if e := p.sleep(w.interval); e != nil {
+      return e
+    }
+  }
+}
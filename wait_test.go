@@ -0,0 +1,164 @@
+package collector
+
+import (
+  "context"
+  "errors"
+  "math"
+  "strings"
+  "sync"
+  "sync/atomic"
+  "testing"
+  "time"
+
+  "github.com/kwf2030/cdp"
+)
+
+var waitRule = `id: "w"
+group: "g"
+patterns: ["example.com"]
+fields:
+  - name: "a"
+    eval: "document.title"
+    export: true
+    wait_for:
+      - selector: "#list"
+        interval: "1ms"
+      - text: "\\d+ items"
+        interval: "1ms"
+  - name: "b"
+    value: "b"
+    export: true
+    wait_for:
+      - gone: ".loading"
+        timeout: "20ms"
+        interval: "1ms"
+`
+
+type errHandler struct {
+  recordHandler
+  mu   sync.Mutex
+  errs []error
+}
+
+func (h *errHandler) OnError(p *Page, stage Stage, name string, e error) {
+  h.mu.Lock()
+  h.errs = append(h.errs, e)
+  h.mu.Unlock()
+}
+
+func TestWaitFor(t *testing.T) {
+  rg := NewRuleGroup("g")
+  if e := rg.AppendBytes([]byte(waitRule)); e != nil {
+    t.Fatal(e)
+  }
+  var polls int32
+  evalFunc := func(expr string) interface{} {
+    switch {
+    case strings.Contains(expr, `"#list"`):
+      // 第3次轮询时出现
+      return atomic.AddInt32(&polls, 1) >= 3
+    case strings.Contains(expr, "innerText"):
+      return "10 items"
+    case strings.Contains(expr, `".loading"`):
+      return false
+    }
+    return "ok"
+  }
+  p := NewPage("http://example.com", "g")
+  h := &errHandler{recordHandler: recordHandler{done: make(chan struct{})}}
+  if e := p.collect(context.Background(), fakeNewTab(evalFunc), rg, h); e != nil {
+    t.Fatal(e)
+  }
+  select {
+  case <-h.done:
+  case <-time.After(time.Second * 5):
+    t.Fatal("timeout")
+  }
+  if polls != 3 {
+    t.Fatalf("want 3 polls, got %d", polls)
+  }
+  if h.record["a"] != "ok" || h.record["b"] != "b" {
+    t.Fatalf("unexpected record %v", h.record)
+  }
+  var we *WaitError
+  if len(h.errs) != 1 || !errors.As(h.errs[0], &we) || we.Cond != "gone .loading" {
+    t.Fatalf("want 1 *WaitError, got %v", h.errs)
+  }
+}
+
+func TestNetworkIdle(t *testing.T) {
+  n := newNetwork()
+  n.last = time.Now().Add(-time.Second)
+  if !n.idle(time.Millisecond * 500) {
+    t.Fatal("should be idle")
+  }
+  n.onEvent(&cdp.Message{Method: cdp.Network.RequestWillBeSent, Params: map[string]interface{}{"requestId": "1"}})
+  if n.idle(0) {
+    t.Fatal("should not be idle with request in flight")
+  }
+  n.onEvent(&cdp.Message{Method: cdp.Network.LoadingFinished, Params: map[string]interface{}{"requestId": "1"}})
+  if !n.idle(0) || n.idle(time.Second) {
+    t.Fatal("idle time should restart after the last request")
+  }
+  // 结束事件先到达
+  n.onEvent(&cdp.Message{Method: cdp.Network.LoadingFailed, Params: map[string]interface{}{"requestId": "2"}})
+  n.onEvent(&cdp.Message{Method: cdp.Network.RequestWillBeSent, Params: map[string]interface{}{"requestId": "2"}})
+  if !n.idle(0) || len(n.finished) != 0 {
+    t.Fatal("request finished out of order should not stay in flight")
+  }
+}
+
+func TestValidateWaitFor(t *testing.T) {
+  data := []byte(`id: "w"
+group: "g"
+patterns: ["x"]
+fields:
+  - name: "a"
+    eval: "1"
+    wait_for:
+      - timeout: "1s"
+      - selector: "a"
+        gone: "b"
+      - text: "("
+      - in: "p"
+        network_idle: "x"
+`)
+  _, e := ParseRule(data)
+  ve, ok := e.(*ValidationError)
+  if !ok {
+    t.Fatalf("want *ValidationError, got %v", e)
+  }
+  want := []string{
+    "8:9 fields[0].wait_for[0]: one of selector",
+    "9:9 fields[0].wait_for[1]: only one condition",
+    "11:15 fields[0].wait_for[2].text: ",
+    `13:23 fields[0].wait_for[3].network_idle: invalid duration "x"`,
+    "12:13 fields[0].wait_for[3].in: in requires text",
+  }
+  if len(ve.Problems) != len(want) {
+    t.Fatalf("want %d problems, got %d: %v", len(want), len(ve.Problems), ve)
+  }
+  for i, p := range ve.Problems {
+    if !strings.HasPrefix(p.String(), want[i]) {
+      t.Errorf("problem %d: want prefix %q, got %q", i, want[i], p.String())
+    }
+  }
+}
+
+// eval条件直接执行（页面的CSP可能不允许eval），按Javascript的真值判断
+func TestWaitForEval(t *testing.T) {
+  w := &WaitFor{Eval: "document.querySelectorAll('li').length"}
+  w.init()
+  if w.expr != "{document.querySelectorAll('li').length}" {
+    t.Fatalf("unexpected expression %q", w.expr)
+  }
+  cases := map[interface{}]bool{nil: false, false: false, true: true, 0.0: false, 3.0: true, "": false, "0": true}
+  for v, want := range cases {
+    if truthy(v) != want {
+      t.Errorf("%#v: want %v", v, want)
+    }
+  }
+  if truthy(math.NaN()) || !truthy([]interface{}{}) || !truthy(map[string]interface{}{}) {
+    t.Error("unexpected truthiness")
+  }
+}
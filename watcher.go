@@ -0,0 +1,262 @@
+package collector
+
+import (
+  "errors"
+  "io/ioutil"
+  "os"
+  "sort"
+  "sync"
+  "time"
+
+  "github.com/kwf2030/commons/file"
+)
+
+var ErrLowerVersion = errors.New("version lower than current rule")
+
+// 重新加载事件类型
+const (
+  // 规则已添加或替换
+  ReloadApplied = iota + 1
+
+  // 规则（或整个文件）被拒绝，原因见ReloadEvent.Err
+  ReloadRejected
+
+  // 文件被删除或文件中不再包含该规则，规则已移除
+  ReloadRemoved
+)
+
+type ReloadEvent struct {
+  Type int
+
+  File string
+
+  // 文件解析或校验失败时为空（整个文件被拒绝）
+  Group   string
+  Id      string
+  Version int
+
+  // ReloadRejected的原因：*LoadError（文件被拒绝，已有规则保持不变）或ErrLowerVersion
+  Err error
+}
+
+type watchedFile struct {
+  modTime time.Time
+  size    int64
+  hash    string
+
+  // 该文件中的规则（group-->ids）
+  rules map[string][]string
+}
+
+// 定时检查目录下的规则文件，有新增、修改或删除时重新加载，
+// 文件中的规则全部通过校验才会应用（否则整个文件被拒绝，已有规则保持不变），
+// 替换规则时按Version比较，已在采集的Page仍使用原来的*Rule
+type Watcher struct {
+  rs       *RuleSet
+  dir      string
+  interval time.Duration
+  handler  func(*ReloadEvent)
+
+  files map[string]*watchedFile
+
+  stopChan chan struct{}
+  once     sync.Once
+  mu       sync.Mutex
+}
+
+// handler可以为nil，在Watcher的goroutine中回调
+func NewWatcher(rs *RuleSet, dir string, interval time.Duration, handler func(*ReloadEvent)) *Watcher {
+  if rs == nil || dir == "" || interval <= 0 {
+    return nil
+  }
+  return &Watcher{
+    rs:       rs,
+    dir:      dir,
+    interval: interval,
+    handler:  handler,
+    files:    make(map[string]*watchedFile, 16),
+    stopChan: make(chan struct{}),
+  }
+}
+
+// 先同步加载一次目录，然后开始定时检查
+func (w *Watcher) Start() error {
+  e := w.Scan()
+  if e != nil {
+    return e
+  }
+  go w.run()
+  return nil
+}
+
+func (w *Watcher) Stop() {
+  w.once.Do(func() {
+    close(w.stopChan)
+  })
+}
+
+func (w *Watcher) run() {
+  ticker := time.NewTicker(w.interval)
+  defer ticker.Stop()
+  for {
+    select {
+    case <-w.stopChan:
+      return
+    case <-ticker.C:
+      w.Scan()
+    }
+  }
+}
+
+// 检查一次目录（Start后会定时调用），只有目录无法读取时才返回错误，
+// 所有文件的变化一次性应用到RuleSet，事件在应用之后回调（handler中可以调用Scan）
+func (w *Watcher) Scan() error {
+  files, e := ruleFiles(w.dir)
+  if e != nil {
+    return e
+  }
+  w.mu.Lock()
+  evts := w.scan(files)
+  w.mu.Unlock()
+  for _, evt := range evts {
+    w.emit(evt)
+  }
+  return nil
+}
+
+func (w *Watcher) scan(files []string) []*ReloadEvent {
+  var evts []*ReloadEvent
+  var rules []*Rule
+  // 规则-->所在的文件
+  sources := make(map[*Rule]string, 8)
+  // 修改或删除的文件中原来的规则
+  olds := make(map[string]map[string][]string, 4)
+  exists := make(map[string]bool, len(files))
+  for _, f := range files {
+    exists[f] = true
+    info, e := os.Stat(f)
+    if e != nil {
+      continue
+    }
+    old := w.files[f]
+    if old != nil && old.modTime.Equal(info.ModTime()) && old.size == info.Size() {
+      continue
+    }
+    wf, parsed, changed, e := w.reload(f, info, old)
+    if e != nil {
+      evts = append(evts, &ReloadEvent{Type: ReloadRejected, File: f, Err: &LoadError{Files: map[string][]error{f: {e}}}})
+    }
+    if wf == nil {
+      continue
+    }
+    w.files[f] = wf
+    if !changed {
+      continue
+    }
+    for _, r := range parsed {
+      rules = append(rules, r)
+      sources[r] = f
+    }
+    if old != nil {
+      olds[f] = old.rules
+    }
+  }
+  for f, old := range w.files {
+    if !exists[f] {
+      delete(w.files, f)
+      olds[f] = old.rules
+    }
+  }
+  removed, removedEvts := w.removed(olds)
+  rejected := make(map[*Rule]bool, 2)
+  for _, r := range w.rs.update(rules, removed) {
+    rejected[r] = true
+  }
+  for _, r := range rules {
+    evt := &ReloadEvent{Type: ReloadApplied, File: sources[r], Group: r.Group, Id: r.Id, Version: r.Version}
+    if rejected[r] {
+      evt.Type = ReloadRejected
+      evt.Err = ErrLowerVersion
+    }
+    evts = append(evts, evt)
+  }
+  return append(evts, removedEvts...)
+}
+
+// 读取并解析文件，changed为false表示内容没变或被拒绝（已有规则保持不变），
+// wf为nil表示无法读取（下次再试）
+func (w *Watcher) reload(f string, info os.FileInfo, old *watchedFile) (wf *watchedFile, rules []*Rule, changed bool, e error) {
+  data, e := ioutil.ReadFile(f)
+  if e != nil {
+    return nil, nil, false, e
+  }
+  hash, _ := file.BytesSHA1(data)
+  wf = &watchedFile{modTime: info.ModTime(), size: info.Size(), hash: hash, rules: make(map[string][]string, 2)}
+  // 内容没变（如只是touch了一下）
+  if old != nil && old.hash == hash {
+    wf.rules = old.rules
+    return wf, nil, false, nil
+  }
+  rules, e = parseRules(data)
+  if e != nil {
+    // 记录modTime，文件再次修改前不会重复报错
+    if old != nil {
+      wf.rules = old.rules
+    }
+    return wf, nil, false, e
+  }
+  for _, r := range rules {
+    wf.rules[r.Group] = append(wf.rules[r.Group], r.Id)
+  }
+  return wf, rules, true, nil
+}
+
+// olds（文件-->原来的规则）中需要移除的规则（group-->ids），
+// 规则可能移到了其它文件中，只移除当前没有任何文件包含的
+func (w *Watcher) removed(olds map[string]map[string][]string) (map[string][]string, []*ReloadEvent) {
+  current := make(map[string]map[string]bool, 4)
+  for _, wf := range w.files {
+    for group, ids := range wf.rules {
+      if current[group] == nil {
+        current[group] = make(map[string]bool, len(ids))
+      }
+      for _, id := range ids {
+        current[group][id] = true
+      }
+    }
+  }
+  files := make([]string, 0, len(olds))
+  for f := range olds {
+    files = append(files, f)
+  }
+  sort.Strings(files)
+  removed := make(map[string][]string, 2)
+  var evts []*ReloadEvent
+  for _, f := range files {
+    for group, ids := range olds[f] {
+      for _, id := range ids {
+        if current[group][id] || contains(removed[group], id) {
+          continue
+        }
+        removed[group] = append(removed[group], id)
+        evts = append(evts, &ReloadEvent{Type: ReloadRemoved, File: f, Group: group, Id: id})
+      }
+    }
+  }
+  return removed, evts
+}
+
+func (w *Watcher) emit(evt *ReloadEvent) {
+  if w.handler != nil {
+    w.handler(evt)
+  }
+}
+
+func contains(arr []string, s string) bool {
+  for _, v := range arr {
+    if v == s {
+      return true
+    }
+  }
+  return false
+}
@@ -0,0 +1,133 @@
+package collector
+
+import (
+  "io/ioutil"
+  "os"
+  "path/filepath"
+  "strconv"
+  "testing"
+  "time"
+)
+
+func TestWatcherScan(t *testing.T) {
+  dir, e := ioutil.TempDir("", "watcher")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+
+  var events []*ReloadEvent
+  rs := NewRuleSet()
+  w := NewWatcher(rs, dir, time.Second, func(evt *ReloadEvent) {
+    events = append(events, evt)
+  })
+  path := filepath.Join(dir, "a.yml")
+  mtime := time.Now()
+  write := func(content string) {
+    if e := ioutil.WriteFile(path, []byte(content), 0644); e != nil {
+      t.Fatal(e)
+    }
+    mtime = mtime.Add(time.Second)
+    os.Chtimes(path, mtime, mtime)
+  }
+  scan := func() []*ReloadEvent {
+    events = nil
+    if e := w.Scan(); e != nil {
+      t.Fatal(e)
+    }
+    return events
+  }
+  rule := func(version int, pattern string) string {
+    return "id: \"1\"\nversion: " + strconv.Itoa(version) + "\ngroup: \"g\"\npatterns: [\"" + pattern + "\"]\nfields:\n  - name: \"x\"\n    eval: \"1\"\n"
+  }
+
+  write(rule(1, "a.com"))
+  if evts := scan(); len(evts) != 1 || evts[0].Type != ReloadApplied || evts[0].Id != "1" {
+    t.Fatalf("unexpected events %+v", evts)
+  }
+  old := rs.Group("g").match("http://a.com")
+  if old == nil {
+    t.Fatal("rule not applied")
+  }
+
+  // 没有变化
+  if evts := scan(); len(evts) != 0 {
+    t.Fatalf("unexpected events %+v", evts)
+  }
+
+  write(rule(2, "b.com"))
+  if evts := scan(); len(evts) != 1 || evts[0].Type != ReloadApplied || evts[0].Version != 2 {
+    t.Fatalf("unexpected events %+v", evts)
+  }
+  if rs.Group("g").match("http://b.com") == nil || rs.Group("g").match("http://a.com") != nil {
+    t.Fatal("rule not replaced")
+  }
+  // 旧规则不受影响
+  if old.Version != 1 || old.Patterns[0] != "a.com" {
+    t.Fatal("old rule modified")
+  }
+
+  write(rule(1, "c.com"))
+  if evts := scan(); len(evts) != 1 || evts[0].Type != ReloadRejected || evts[0].Err != ErrLowerVersion {
+    t.Fatalf("unexpected events %+v", evts)
+  }
+
+  write("id: \"1\"\nversion: 3\ngroup: \"g\"\npatterns: [\"(\"]\n")
+  evts := scan()
+  if len(evts) != 1 || evts[0].Type != ReloadRejected {
+    t.Fatalf("unexpected events %+v", evts)
+  }
+  if _, ok := evts[0].Err.(*LoadError); !ok {
+    t.Fatalf("want *LoadError, got %v", evts[0].Err)
+  }
+  if rs.Group("g").match("http://b.com") == nil {
+    t.Fatal("rejected file should keep current rule")
+  }
+
+  os.Remove(path)
+  if evts := scan(); len(evts) != 1 || evts[0].Type != ReloadRemoved || evts[0].Id != "1" {
+    t.Fatalf("unexpected events %+v", evts)
+  }
+  if rs.Group("g").match("http://b.com") != nil {
+    t.Fatal("rule not removed")
+  }
+}
+
+func TestWatcherMove(t *testing.T) {
+  dir, e := ioutil.TempDir("", "watcher")
+  if e != nil {
+    t.Fatal(e)
+  }
+  defer os.RemoveAll(dir)
+  rule := "id: \"1\"\ngroup: \"g\"\npatterns: [\"a.com\"]\nfields:\n  - name: \"x\"\n    eval: \"1\"\n"
+  a, b := filepath.Join(dir, "a.yml"), filepath.Join(dir, "b.yml")
+  if e := ioutil.WriteFile(a, []byte(rule), 0644); e != nil {
+    t.Fatal(e)
+  }
+  var events []*ReloadEvent
+  rs := NewRuleSet()
+  var w *Watcher
+  w = NewWatcher(rs, dir, time.Second, func(evt *ReloadEvent) {
+    events = append(events, evt)
+    // 在handler中调用Scan不会死锁
+    w.Scan()
+  })
+  if e := w.Scan(); e != nil {
+    t.Fatal(e)
+  }
+  // 规则从a.yml移到b.yml，不会被移除
+  os.Remove(a)
+  if e := ioutil.WriteFile(b, []byte(rule), 0644); e != nil {
+    t.Fatal(e)
+  }
+  events = nil
+  if e := w.Scan(); e != nil {
+    t.Fatal(e)
+  }
+  if len(events) != 1 || events[0].Type != ReloadApplied || events[0].File != b {
+    t.Fatalf("unexpected events %+v", events)
+  }
+  if rs.Group("g").match("http://a.com") == nil {
+    t.Fatal("moved rule removed")
+  }
+}